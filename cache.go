@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// redirectCache is an LRU cache of shortlinks by the keys of their shorts and aliases,
+// including misses of shorts without shortlink, so redirects don't have to read from the store.
+// Entries expire after a TTL to pick up changes made by other instances of the service.
+type redirectCache struct {
+	// Maximum number of entries
+	size int
+	// Time shortlinks and misses are cached
+	ttl     time.Duration
+	missTTL time.Duration
+	// Guards all following fields
+	mu sync.Mutex
+	// Entries from the most to the least recently used
+	lru *list.List
+	// Elements of the entries by their key
+	entries map[string]*list.Element
+	// Keys of the cached entries by the ID of their shortlink
+	keys map[primitive.ObjectID]map[string]bool
+	// Number of invalidations, shortlinks loaded before an invalidation are not cached
+	invalidations uint64
+	// Number of lookups by their result
+	results map[string]uint64
+}
+
+// Results of looking up a key in a redirectCache
+const (
+	// A shortlink was cached
+	cacheHit = "hit"
+	// A miss was cached
+	cacheNegativeHit = "negative_hit"
+	// Nothing was cached
+	cacheMiss = "miss"
+)
+
+// Entry of a redirectCache
+type cacheEntry struct {
+	key string
+	// Cached shortlink, nil if there is none with the short
+	link    *Shortlink
+	expires time.Time
+}
+
+// newRedirectCache returns an empty cache of up to `size` entries
+func newRedirectCache(size int, ttl time.Duration, missTTL time.Duration) *redirectCache {
+	return &redirectCache{
+		size:    size,
+		ttl:     ttl,
+		missTTL: missTTL,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		keys:    map[primitive.ObjectID]map[string]bool{},
+		results: map[string]uint64{},
+	}
+}
+
+// load returns a copy of the shortlink cached for the key or ErrNotFound if a miss is cached,
+// otherwise it returns the result of `fetch` and caches it if it is a shortlink or ErrNotFound
+func (c *redirectCache) load(key string, fetch func() (*Shortlink, error)) (*Shortlink, error) {
+	link, found, invalidations := c.get(key)
+	if found && link == nil {
+		return nil, ErrNotFound
+	}
+	if found {
+		return link, nil
+	}
+
+	// Shortlinks with a maximum number of clicks aren't cached as every redirect changes their access count
+	link, err := fetch()
+	if err == nil && link.MaxClicks == 0 {
+		c.add(key, link, invalidations)
+	} else if isNotFundError(err) {
+		c.add(key, nil, invalidations)
+	}
+	return link, err
+}
+
+// get returns a copy of the shortlink cached for the key and true if there is an entry,
+// nil and true if a miss is cached and false and the current number of invalidations if there is no entry
+func (c *redirectCache) get(key string) (*Shortlink, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.results[cacheMiss]++
+		return nil, false, c.invalidations
+	}
+	entry := element.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.remove(element)
+		c.results[cacheMiss]++
+		return nil, false, c.invalidations
+	}
+	c.lru.MoveToFront(element)
+	if entry.link == nil {
+		c.results[cacheNegativeHit]++
+		return nil, true, 0
+	}
+	c.results[cacheHit]++
+	result := *entry.link
+	return &result, true, 0
+}
+
+// add caches a copy of the shortlink for the key, a miss if `link` is nil,
+// unless the cache was invalidated since `invalidations` as the shortlink may be outdated.
+// Shortlinks are cached until they expire at most, as expired shortlinks may be purged without notice.
+func (c *redirectCache) add(key string, link *Shortlink, invalidations uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entry := &cacheEntry{key: key, expires: now.Add(c.missTTL)}
+	if link != nil {
+		entry.expires = now.Add(c.ttl)
+		if link.ExpiresAt != nil && link.ExpiresAt.Before(entry.expires) {
+			entry.expires = *link.ExpiresAt
+		}
+	}
+	if c.invalidations != invalidations || !now.Before(entry.expires) {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if link != nil {
+		stored := *link
+		entry.link = &stored
+		if c.keys[link.ID] == nil {
+			c.keys[link.ID] = map[string]bool{}
+		}
+		c.keys[link.ID][key] = true
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate evicts the entries of the keys and all entries of the shortlink with the ID
+func (c *redirectCache) invalidate(id primitive.ObjectID, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidations++
+	for key := range c.keys[id] {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+// clear evicts all entries
+func (c *redirectCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidations++
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.keys = map[primitive.ObjectID]map[string]bool{}
+}
+
+// lookups returns the number of lookups with the result, one of cacheHit, cacheNegativeHit or cacheMiss
+func (c *redirectCache) lookups(result string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.results[result]
+}
+
+// len returns the number of entries
+func (c *redirectCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove evicts the entry of the element, c.mu must be held
+func (c *redirectCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if entry.link != nil {
+		delete(c.keys[entry.link.ID], entry.key)
+		if len(c.keys[entry.link.ID]) == 0 {
+			delete(c.keys, entry.link.ID)
+		}
+	}
+}
+
+// Time the shorts suggested for missing redirects are cached
+const shortsTTL = time.Minute
+
+// shortsCache caches the shorts and aliases of all shortlinks suggested for missing redirects,
+// so requests of unknown shorts don't read all shorts from the store every time
+type shortsCache struct {
+	// Guards all following fields
+	mu sync.Mutex
+	// Cached shorts, nil if none
+	shorts  []string
+	expires time.Time
+	// Number of invalidations, shorts loaded before an invalidation are not cached
+	invalidations uint64
+}
+
+// load returns the cached shorts, otherwise it caches and returns the result of `fetch`
+func (c *shortsCache) load(fetch func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	shorts, expires, invalidations := c.shorts, c.expires, c.invalidations
+	c.mu.Unlock()
+	if shorts != nil && time.Now().Before(expires) {
+		return shorts, nil
+	}
+
+	shorts, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidations == invalidations {
+		c.shorts = shorts
+		c.expires = time.Now().Add(shortsTTL)
+	}
+	return shorts, nil
+}
+
+// invalidate evicts the cached shorts
+func (c *shortsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	c.shorts = nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Config contains the settings of the shorty service
+type Config struct {
+	// Number of characters of shorts generated if none is provided on create
+	GenerateLength int
+	// Alphabet of generated shorts, `base62`, `pronounceable` or a string of allowed characters
+	GenerateAlphabet string
+	// Number of generated shorts to try before giving up if they are already taken
+	GenerateAttempts int
+	// Base URL of the service, e.g. https://go.example.com, used to build redirect URLs.
+	// Derived from the request if empty.
+	BaseURL string
+	// HTTP status code of redirects of shortlinks without a redirect type, one of RedirectTypes
+	RedirectType int
+	// URL to redirect to with RedirectType instead of responding 410 (Gone) if a shortlink expired, optional
+	ExpiredURL string
+	// HTTP status code of requests to disabled shortlinks, 410 (Gone) or 451 (Unavailable For Legal Reasons)
+	DisabledStatus int
+	// Error message returned for disabled shortlinks
+	DisabledMessage string
+	// Seconds deleted shortlinks are kept in the trash, forever if 0
+	TrashRetention int
+	// Keep the shorts of deleted shortlinks reserved until they are purged from the trash
+	ReserveDeletedShorts bool
+	// Resolve shorts regardless of their case and of `_` and `-`, e.g. go/On_Call as go/on-call,
+	// which requires them to be unique as well
+	NormalizeShorts bool
+	// Request header containing the user recorded as author of revisions, e.g. set by an authenticating proxy
+	AuthorHeader string
+	// Record a click event with the referrer, user agent, hashed client IP and language of every redirect
+	RecordEvents bool
+	// Seconds click events are kept, forever if 0
+	EventRetention int
+	// Key of the HMAC hashing the client IPs of click events, random per process if empty
+	// so hashes only identify clients until the service restarts
+	EventIPKey string
+	// Milliseconds redirects are counted in memory before their access counts are written in bulk,
+	// counted synchronously with every redirect if 0. Shortlinks with a maximum number of clicks are always
+	// counted synchronously.
+	AccessCountInterval int
+	// Number of shorts cached for redirects including misses, no cache if 0.
+	// Requires AccessCountInterval as redirects counted by the store read the shortlink anyway.
+	RedirectCacheSize int
+	// Seconds shortlinks and misses are cached for redirects, changes made via other instances of the service
+	// may take this long to become visible
+	RedirectCacheTTL     int
+	RedirectCacheMissTTL int
+	// How the redirect cache learns about shortlinks changed by other instances of the service, one of WatchModes.
+	// Only MongoDB supports it, watching its change streams or polling a standalone server.
+	CacheWatch string
+	// Seconds between polls for changes
+	CachePollInterval int
+	// Seconds between purging expired shortlinks, never if 0.
+	// MongoDB additionally deletes expired shortlinks via a TTL index if set.
+	PurgeInterval int
+}
+
+// DefaultConfig returns the default settings
+func DefaultConfig() *Config {
+	return &Config{
+		GenerateLength:   6,
+		GenerateAlphabet: "base62",
+		GenerateAttempts: 5,
+		RedirectType:     http.StatusTemporaryRedirect,
+		DisabledStatus:   http.StatusGone,
+		DisabledMessage:  "shortlink disabled",
+		// 30 days
+		TrashRetention: 30 * 24 * 60 * 60,
+		AuthorHeader:   "X-Forwarded-User",
+		RecordEvents:   true,
+		// 90 days
+		EventRetention:       90 * 24 * 60 * 60,
+		AccessCountInterval:  1000,
+		RedirectCacheSize:    10000,
+		RedirectCacheTTL:     60,
+		RedirectCacheMissTTL: 10,
+		CacheWatch:           WatchAuto,
+		CachePollInterval:    5,
+	}
+}
+
+// ConfigFromEnv returns the default settings overridden by the environment variables
+// SHORTY_GENERATE_LENGTH, SHORTY_GENERATE_ALPHABET, SHORTY_GENERATE_ATTEMPTS, SHORTY_BASE_URL,
+// SHORTY_REDIRECT_TYPE, SHORTY_EXPIRED_URL, SHORTY_DISABLED_STATUS, SHORTY_DISABLED_MESSAGE,
+// SHORTY_TRASH_RETENTION, SHORTY_RESERVE_DELETED_SHORTS, SHORTY_NORMALIZE_SHORTS, SHORTY_AUTHOR_HEADER,
+// SHORTY_RECORD_EVENTS, SHORTY_EVENT_RETENTION, SHORTY_EVENT_IP_KEY, SHORTY_ACCESS_COUNT_INTERVAL,
+// SHORTY_REDIRECT_CACHE_SIZE, SHORTY_REDIRECT_CACHE_TTL, SHORTY_REDIRECT_CACHE_MISS_TTL,
+// SHORTY_CACHE_WATCH, SHORTY_CACHE_POLL_INTERVAL and SHORTY_PURGE_INTERVAL.
+func ConfigFromEnv() (*Config, error) {
+	config := DefaultConfig()
+	if err := envInt("SHORTY_GENERATE_LENGTH", &config.GenerateLength); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_GENERATE_ALPHABET", &config.GenerateAlphabet)
+	if err := envInt("SHORTY_GENERATE_ATTEMPTS", &config.GenerateAttempts); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_BASE_URL", &config.BaseURL)
+	if err := envInt("SHORTY_REDIRECT_TYPE", &config.RedirectType); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_EXPIRED_URL", &config.ExpiredURL)
+	if err := envInt("SHORTY_DISABLED_STATUS", &config.DisabledStatus); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_DISABLED_MESSAGE", &config.DisabledMessage)
+	if err := envInt("SHORTY_TRASH_RETENTION", &config.TrashRetention); err != nil {
+		return nil, err
+	}
+	if err := envBool("SHORTY_RESERVE_DELETED_SHORTS", &config.ReserveDeletedShorts); err != nil {
+		return nil, err
+	}
+	if err := envBool("SHORTY_NORMALIZE_SHORTS", &config.NormalizeShorts); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_AUTHOR_HEADER", &config.AuthorHeader)
+	if err := envBool("SHORTY_RECORD_EVENTS", &config.RecordEvents); err != nil {
+		return nil, err
+	}
+	if err := envInt("SHORTY_EVENT_RETENTION", &config.EventRetention); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_EVENT_IP_KEY", &config.EventIPKey)
+	if err := envInt("SHORTY_ACCESS_COUNT_INTERVAL", &config.AccessCountInterval); err != nil {
+		return nil, err
+	}
+	if err := envInt("SHORTY_REDIRECT_CACHE_SIZE", &config.RedirectCacheSize); err != nil {
+		return nil, err
+	}
+	if err := envInt("SHORTY_REDIRECT_CACHE_TTL", &config.RedirectCacheTTL); err != nil {
+		return nil, err
+	}
+	if err := envInt("SHORTY_REDIRECT_CACHE_MISS_TTL", &config.RedirectCacheMissTTL); err != nil {
+		return nil, err
+	}
+	envString("SHORTY_CACHE_WATCH", &config.CacheWatch)
+	if err := envInt("SHORTY_CACHE_POLL_INTERVAL", &config.CachePollInterval); err != nil {
+		return nil, err
+	}
+	if err := envInt("SHORTY_PURGE_INTERVAL", &config.PurgeInterval); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// envString sets `value` to the environment variable `key` if it is set
+func envString(key string, value *string) {
+	if v := os.Getenv(key); v != "" {
+		*value = v
+	}
+}
+
+// envInt sets `value` to the environment variable `key` if it is set
+func envInt(key string, value *int) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	*value = i
+	return nil
+}
+
+// envBool sets `value` to the environment variable `key` if it is set
+func envBool(key string, value *bool) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	*value = b
+	return nil
+}
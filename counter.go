@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// accessCounter counts redirects in memory and adds them to the access counts in the store in bulk,
+// so redirects only read from the store and hot shortlinks don't serialize writes.
+// Counts not yet written are lost if the service is killed without flushing them.
+type accessCounter struct {
+	store Store
+	// Time counts wait for further redirects before they are written
+	interval time.Duration
+	// Guards all following fields
+	mu sync.Mutex
+	// Counts not yet passed to the store by the ID of their shortlink
+	pending map[primitive.ObjectID]int
+	// Counts being written by the ID of their shortlink
+	writing map[primitive.ObjectID]int
+	// Scheduled flush of the pending counts, nil if none
+	timer *time.Timer
+	// Writes in progress
+	writes sync.WaitGroup
+}
+
+// newAccessCounter returns an accessCounter writing to the store every `interval`
+func newAccessCounter(store Store, interval time.Duration) *accessCounter {
+	return &accessCounter{
+		store:    store,
+		interval: interval,
+		pending:  map[primitive.ObjectID]int{},
+		writing:  map[primitive.ObjectID]int{},
+	}
+}
+
+// count counts a redirect of the shortlink and increments its access count
+func (c *accessCounter) count(link *Shortlink) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	link.AccessCount++
+	c.pending[link.ID]++
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.interval, c.flush)
+	}
+}
+
+// addUnwritten adds the counts not yet written to the access count of the shortlink loaded from the store,
+// does nothing if `c` is nil
+func (c *accessCounter) addUnwritten(link *Shortlink) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	link.AccessCount += c.pending[link.ID] + c.writing[link.ID]
+}
+
+// flush writes the pending counts in the background
+func (c *accessCounter) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) == 0 {
+		return
+	}
+	counts := c.pending
+	c.pending = map[primitive.ObjectID]int{}
+	for id, n := range counts {
+		c.writing[id] += n
+	}
+	c.writes.Add(1)
+	go c.write(counts)
+}
+
+// write adds the counts to the store, failed counts are retried with the next flush
+func (c *accessCounter) write(counts map[primitive.ObjectID]int) {
+	defer c.writes.Done()
+	err := c.store.IncrementAccessCounts(counts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, n := range counts {
+		if c.writing[id] -= n; c.writing[id] == 0 {
+			delete(c.writing, id)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed writing access counts of %d shortlinks: %v", len(counts), err)
+		for id, n := range counts {
+			c.pending[id] += n
+		}
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.interval, c.flush)
+		}
+	}
+}
+
+// Flush writes all pending counts and waits until they are written
+func (c *accessCounter) Flush() {
+	c.flush()
+	c.writes.Wait()
+}
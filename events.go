@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ClickEvent is recorded for every redirect of a shortlink
+type ClickEvent struct {
+	// ID of the shortlink
+	ShortlinkID primitive.ObjectID `json:"-" bson:"shortlink_id"`
+	// Short or alias used in the redirect
+	Short     string    `json:"short" bson:"short"`
+	ClickedAt time.Time `json:"clicked_at" bson:"clicked_at"`
+	Referrer  string    `json:"referrer,omitempty" bson:"referrer"`
+	UserAgent string    `json:"user_agent,omitempty" bson:"user_agent"`
+	// Keyed hash of the client IP, identifies clients without storing their IP
+	ClientHash     string `json:"client_hash,omitempty" bson:"client_hash"`
+	AcceptLanguage string `json:"accept_language,omitempty" bson:"accept_language"`
+}
+
+// Number of events written to the store at once
+const eventBatchSize = 100
+
+// Maximum number of events waiting to be written, further events are dropped
+const maxPendingEvents = 10000
+
+// Time events wait for more events before they are written
+var eventFlushInterval = time.Second
+
+// eventLog writes click events to an EventStore asynchronously in batches,
+// so recording an event never waits for the store
+type eventLog struct {
+	store EventStore
+	// Key of the HMAC hashing client IPs
+	ipKey []byte
+	// Guards all following fields
+	mu sync.Mutex
+	// Events not yet passed to the store
+	buffer []*ClickEvent
+	// Events buffered or being written
+	pending int
+	// Number of events dropped since the last log message
+	dropped int
+	// Scheduled flush of the buffer, nil if none
+	timer *time.Timer
+	// Writes in progress
+	writing sync.WaitGroup
+}
+
+// newEventLog returns an eventLog writing to the store and hashing client IPs with `ipKey`,
+// a random key if empty
+func newEventLog(store EventStore, ipKey string) (*eventLog, error) {
+	key := []byte(ipKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &eventLog{store: store, ipKey: key}, nil
+}
+
+// record queues the click event of a redirect of the shortlink via `short`
+func (l *eventLog) record(c *gin.Context, link *Shortlink, short string) {
+	l.add(&ClickEvent{
+		ShortlinkID:    link.ID,
+		Short:          short,
+		ClickedAt:      storeTime(),
+		Referrer:       c.Request.Referer(),
+		UserAgent:      c.Request.UserAgent(),
+		ClientHash:     l.hashIP(c.ClientIP()),
+		AcceptLanguage: c.GetHeader("Accept-Language"),
+	})
+}
+
+// add queues the event, writing the buffer once it is full or after eventFlushInterval
+func (l *eventLog) add(event *ClickEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending >= maxPendingEvents {
+		if l.dropped == 0 {
+			log.Printf("Too many click events pending, dropping events")
+		}
+		l.dropped++
+		return
+	}
+	if l.dropped > 0 {
+		log.Printf("Dropped %d click events", l.dropped)
+		l.dropped = 0
+	}
+
+	l.buffer = append(l.buffer, event)
+	l.pending++
+	if len(l.buffer) >= eventBatchSize {
+		l.flushLocked()
+	} else if l.timer == nil {
+		l.timer = time.AfterFunc(eventFlushInterval, l.flush)
+	}
+}
+
+// flush writes the buffered events in the background
+func (l *eventLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked()
+}
+
+// flushLocked writes the buffered events in the background, l.mu must be held
+func (l *eventLog) flushLocked() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if len(l.buffer) == 0 {
+		return
+	}
+	events := l.buffer
+	l.buffer = nil
+	l.writing.Add(1)
+	go l.write(events)
+}
+
+// write passes the events to the store
+func (l *eventLog) write(events []*ClickEvent) {
+	defer l.writing.Done()
+	if err := l.store.AddEvents(events); err != nil {
+		log.Printf("Failed writing %d click events: %v", len(events), err)
+	}
+	l.mu.Lock()
+	l.pending -= len(events)
+	l.mu.Unlock()
+}
+
+// Close writes all buffered events and waits until they are written
+func (l *eventLog) Close() {
+	l.flush()
+	l.writing.Wait()
+}
+
+// hashIP returns the hex encoded HMAC-SHA256 of the IP
+func (l *eventLog) hashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, l.ipKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+)
+
+// Alphabet of the default base62 scheme
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Consonants and vowels of the pronounceable scheme
+const (
+	pronounceableConsonants = "bdfghjklmnprstvz"
+	pronounceableVowels     = "aeiou"
+)
+
+// shortGenerator generates random shorts of a fixed length
+type shortGenerator struct {
+	// Number of characters of a generated short
+	length int
+	// Characters a generated short consists of, ignored if pronounceable is set
+	alphabet string
+	// Alternate consonants and vowels to generate pronounceable shorts
+	pronounceable bool
+}
+
+// newShortGenerator returns a generator for shorts of the given length using the alphabet
+// `base62`, `pronounceable` or the characters of the provided string.
+func newShortGenerator(length int, alphabet string) (*shortGenerator, error) {
+	if length < 1 {
+		return nil, fmt.Errorf("invalid length %d for generated shorts", length)
+	}
+	switch alphabet {
+	case "", "base62":
+		return &shortGenerator{length: length, alphabet: base62Alphabet}, nil
+	case "pronounceable":
+		return &shortGenerator{length: length, pronounceable: true}, nil
+	}
+	if m, _ := regexp.MatchString("^[a-zA-Z0-9\\-_]+$", alphabet); !m {
+		return nil, fmt.Errorf("invalid alphabet %q for generated shorts", alphabet)
+	}
+	return &shortGenerator{length: length, alphabet: alphabet}, nil
+}
+
+// generate returns a new random short
+func (g *shortGenerator) generate() (string, error) {
+	short := make([]byte, g.length)
+	for i := range short {
+		alphabet := g.alphabet
+		if g.pronounceable {
+			alphabet = pronounceableConsonants
+			if i%2 == 1 {
+				alphabet = pronounceableVowels
+			}
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		short[i] = alphabet[n.Int64()]
+	}
+	return string(short), nil
+}
@@ -3,7 +3,10 @@ module github.com/bnord01/shorty
 go 1.13
 
 require (
-	github.com/gin-gonic/gin v1.7.4
+	github.com/gin-gonic/gin v1.7.7
+	github.com/lib/pq v1.10.3
+	github.com/mattn/go-sqlite3 v1.14.8
+	github.com/prometheus/client_golang v1.11.0
 	github.com/stretchr/testify v1.7.0
 	go.mongodb.org/mongo-driver v1.7.2
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
@@ -1,42 +1,115 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
 )
 
 /* ********************************************** *\
  * ****************** HANDLERS ****************** *
 \* ********************************************** */
 
+// The handlers are methods of server to have access to the injected Store and settings.
+type server struct {
+	store     Store
+	config    *Config
+	generator *shortGenerator
+	// Caches the shorts suggested for missing redirects
+	shorts shortsCache
+	// Records click events of redirects, nil if disabled
+	events *eventLog
+	// Counts redirects in memory, nil if they are counted synchronously by the store
+	counter *accessCounter
+	// Caches shortlinks to redirect to, nil if disabled
+	cache *redirectCache
+	// Prometheus metrics served at /metrics
+	metrics *metrics
+}
+
 // Handler for GET /shortlinks
-// Returns code 200 with [..shortlinks..] on success and
+// Supports the query parameters
+// limit (default 100, max 1000), page_token (next_page_token of the previous page),
+// sort (short, created_at, updated_at or access_count, prefixed with - for descending order),
+// prefix (of the short), host (of the target URL), created_after/created_before (RFC 3339 timestamps)
+// and state (active, scheduled, expired or disabled).
+// Returns code 200 with {shortlinks:[..shortlinks..], total:n, next_page_token:token} on success,
+// code 400 with {error:msg} if a query parameter is invalid and
 // code 500 with {error:msg} in case of an error.
-func handleGetShortlinks(c *gin.Context) {
-	var loadedShortlinks, err = GetAllShortlinks()
+func (s *server) handleGetShortlinks(c *gin.Context) {
+	query, err := parseListQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	loadedShortlinks, total, err := s.store.ListShortlinks(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.page(loadedShortlinks, total, query.Offset, c))
+}
+
+// Handler for GET /shortlinks/search
+// Searches shortlinks by the query parameter q matching shorts, descriptions and target URLs,
+// optionally limited by limit (default 20, max 100).
+// Returns code 200 with {shortlinks:[..shortlinks..], total:n} ranked by relevance on success,
+// code 400 if the query is missing or the limit is invalid and
+// code 500 in case of another error.
+func (s *server) handleSearch(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing search query q"})
+		return
+	}
+	limit := defaultSearchLimit
+	if l := c.Query("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit, must be between 1 and %d", maxSearchLimit)})
+			return
+		}
+	}
+
+	results, err := s.store.Search(query, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, loadedShortlinks)
+
+	page := &ShortlinkPage{Shortlinks: make([]*ShortlinkResponse, len(results)), Total: int64(len(results))}
+	for i, shortlink := range results {
+		page.Shortlinks[i] = s.response(shortlink, c)
+	}
+	c.JSON(http.StatusOK, page)
 }
 
 // Handler for GET /shortlinks/:short
-// Returns code 200 with the requested shortlink as json on success,
+// Returns code 200 with the requested shortlink, which may also be given by one of its aliases, as json on success,
 // code 400 if the short is invalid, 404 if the shortlinks doesn't exist and
 // code 500 in case of another error.
-func handleGetShortlink(c *gin.Context) {
+func (s *server) handleGetShortlink(c *gin.Context) {
 	short := c.Param("short")
 	if invalidShort(short, c) {
 		return
 	}
-	var loadedShortlink, err = GetShortlinkByShort(short)
+	var loadedShortlink, err = s.store.GetShortlinkByShort(short)
 	if err != nil {
 		// Code 404 if not found
 		if isNotFundError(err) {
@@ -49,15 +122,16 @@ func handleGetShortlink(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, loadedShortlink)
+	c.JSON(http.StatusOK, s.response(loadedShortlink, c))
 }
 
 // Handler for POST /shortlinks
-// Creates the shortlink provided as json and returns code 201 if successfull,
+// Creates the shortlink provided as json, generating a short if none is provided.
+// Returns code 201 with the created shortlink as json and its location if successfull,
 // code 400 if the shortlink is invalid,
-// code 409 if it already exists and
+// code 409 if its short or one of its aliases is taken or no free short could be generated and
 // code 500 in case of another error.
-func handleCreateShortlink(c *gin.Context) {
+func (s *server) handleCreateShortlink(c *gin.Context) {
 	var shortlink Shortlink
 	if err := c.ShouldBindJSON(&shortlink); err != nil {
 		log.Print(err)
@@ -65,12 +139,29 @@ func handleCreateShortlink(c *gin.Context) {
 		return
 	}
 
-	if invalidShort(shortlink.ShortUrl, c) || invalidURL(shortlink.LongUrl, c) {
+	// Fields maintained by the service can't be set by clients
+	shortlink.AccessCount = 0
+	shortlink.DeletedAt = nil
+
+	generate := shortlink.ShortUrl == ""
+	if (!generate && invalidShort(shortlink.ShortUrl, c)) ||
+		invalidAliases(shortlink.ShortUrl, shortlink.Aliases, s.shortKey, c) ||
+		invalidURL(shortlink.LongUrl, c) || invalidRedirectType(shortlink.RedirectType, c) ||
+		invalidMaxClicks(shortlink.MaxClicks, c) {
 		return
 	}
 
-	err := Create(&shortlink)
+	var err error
+	if generate {
+		err = s.createWithGeneratedShort(&shortlink)
+	} else if err = s.checkReserved(shortlink.ShortUrl); err == nil {
+		err = s.store.Create(&shortlink)
+	}
 	if err != nil {
+		if isDuplicateError(err) && generate {
+			c.JSON(http.StatusConflict, gin.H{"error": "could not generate a free short"})
+			return
+		}
 		if isDuplicateError(err) {
 			c.JSON(http.StatusConflict, gin.H{"error": "shortlink already exists"})
 			return
@@ -78,7 +169,32 @@ func handleCreateShortlink(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.Status(http.StatusCreated)
+	s.invalidate(&shortlink)
+	s.recordRevision(c, RevisionCreate, &shortlink, 0)
+	c.Header("Location", "/shortlinks/"+shortlink.ShortUrl)
+	c.JSON(http.StatusCreated, s.response(&shortlink, c))
+}
+
+// createWithGeneratedShort creates the shortlink with a generated short,
+// retrying with a new short if the generated one is already taken.
+func (s *server) createWithGeneratedShort(shortlink *Shortlink) error {
+	var err error
+	for i := 0; i < s.config.GenerateAttempts; i++ {
+		shortlink.ShortUrl, err = s.generator.generate()
+		if err != nil {
+			return err
+		}
+		if containsShort(shortlink.Aliases, shortlink.ShortUrl, s.shortKey) {
+			err = ErrDuplicate
+		} else if err = s.checkReserved(shortlink.ShortUrl); err == nil {
+			err = s.store.Create(shortlink)
+		}
+		if !isDuplicateError(err) {
+			return err
+		}
+		log.Printf("Generated short %s is already taken", shortlink.ShortUrl)
+	}
+	return err
 }
 
 // Handler for PUT /shortlinks/:short
@@ -86,9 +202,9 @@ func handleCreateShortlink(c *gin.Context) {
 // Returns code 200 with the updated shortlink as json on success,
 // code 400 if the data is invalid,
 // code 404 if the short link does not exist
-// code 409 if there is already a shortlink with the updated short and
+// code 409 if the updated short or one of the aliases is taken by another shortlink and
 // code 500 in case of another error.
-func handleUpdateShortlink(c *gin.Context) {
+func (s *server) handleUpdateShortlink(c *gin.Context) {
 	short := c.Param("short")
 	if invalidShort(short, c) {
 		return
@@ -99,11 +215,22 @@ func handleUpdateShortlink(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if invalidShort(shortlink.ShortUrl, c) || invalidURL(shortlink.LongUrl, c) {
+	if invalidShort(shortlink.ShortUrl, c) ||
+		invalidAliases(shortlink.ShortUrl, shortlink.Aliases, s.shortKey, c) ||
+		invalidURL(shortlink.LongUrl, c) || invalidRedirectType(shortlink.RedirectType, c) ||
+		invalidMaxClicks(shortlink.MaxClicks, c) {
 		return
 	}
 
-	savedShortlink, err := Update(short, &shortlink)
+	// Resolve aliases to the short the store updates by
+	existing, err := s.store.GetShortlinkByShort(short)
+	if err == nil && shortlink.ShortUrl != existing.ShortUrl {
+		err = s.checkReserved(shortlink.ShortUrl)
+	}
+	var savedShortlink *Shortlink
+	if err == nil {
+		savedShortlink, err = s.store.Update(existing.ShortUrl, &shortlink)
+	}
 	if err != nil {
 		if isDuplicateError(err) {
 			c.JSON(http.StatusConflict, gin.H{"error": "shortlink already exists"})
@@ -116,62 +243,498 @@ func handleUpdateShortlink(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, savedShortlink)
+	s.invalidate(savedShortlink)
+	s.recordRevision(c, RevisionUpdate, savedShortlink, 0)
+	c.JSON(http.StatusOK, s.response(savedShortlink, c))
+}
+
+// checkReserved returns ErrDuplicate if deleted shorts are reserved and there is a deleted shortlink `short`
+func (s *server) checkReserved(short string) error {
+	if !s.config.ReserveDeletedShorts {
+		return nil
+	}
+	trashed, err := s.store.IsTrashed(short)
+	if err != nil {
+		return err
+	}
+	if trashed {
+		return ErrDuplicate
+	}
+	return nil
 }
 
 // Handler for DELETE /shortlinks/:short
+// Moves the shortlink to the trash.
 // Returns code 200 with {deleted:1} on success if the shortlink existed,
 // code 200 with {deleted:0} if the provided shortlink did not exist,
 // code 400 if the provided short is invalid and
 // code 500 in case of another error.
-func handleDeleteShortlink(c *gin.Context) {
+func (s *server) handleDeleteShortlink(c *gin.Context) {
 	short := c.Param("short")
 	if invalidShort(short, c) {
 		return
 	}
 
-	num_deleted, err := Delete(short)
+	// Load the shortlink to record its revision and resolve aliases to the short the store deletes by
+	shortlink, err := s.store.GetShortlinkByShort(short)
+	if isNotFundError(err) {
+		c.JSON(http.StatusOK, gin.H{"deleted": 0})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	num_deleted, err := s.store.Delete(shortlink.ShortUrl)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if num_deleted > 0 {
+		s.invalidate(shortlink)
+		s.recordRevision(c, RevisionDelete, shortlink, 0)
+	}
 	c.JSON(http.StatusOK, gin.H{"deleted": num_deleted})
 }
 
-// Handler for GET /go/:short
-// Returns code 307 (TemporaryRedirect) to the saved link on success,
-// code 400 if the shortlink is invalid, 404 if it doesn't exist and
+// Handler for GET /trash
+// Supports the query parameters limit (default 100, max 1000) and page_token (next_page_token of the previous page).
+// Returns code 200 with {shortlinks:[..deleted shortlinks..], total:n, next_page_token:token},
+// most recently deleted first, on success,
+// code 400 with {error:msg} if a query parameter is invalid and
+// code 500 with {error:msg} in case of an error.
+func (s *server) handleGetTrash(c *gin.Context) {
+	query := &ListQuery{Limit: defaultPageSize}
+	if err := parsePagination(c, query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	trash, total, err := s.store.ListTrash(query.Offset, query.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.page(trash, total, query.Offset, c))
+}
+
+// Handler for POST /trash/:short/restore
+// Restores the most recently deleted shortlink with the short.
+// Returns code 200 with the restored shortlink as json on success,
+// code 400 if the short is invalid,
+// code 404 if there is no deleted shortlink with the short,
+// code 409 if the short is taken by another shortlink and
+// code 500 in case of another error.
+func (s *server) handleRestore(c *gin.Context) {
+	short := c.Param("short")
+	if invalidShort(short, c) {
+		return
+	}
+
+	restored, err := s.store.Restore(short)
+	if err != nil {
+		if isNotFundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shortlink not found in trash"})
+			return
+		}
+		if isDuplicateError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "shortlink already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.invalidate(restored)
+	s.recordRevision(c, RevisionRestore, restored, 0)
+	c.JSON(http.StatusOK, s.response(restored, c))
+}
+
+// Handler for GET /shortlinks/:short/history
+// Returns code 200 with {revisions:[..revisions..]} of the shortlink, oldest first, on success,
+// including revisions made before its short was changed,
+// each with the fields changed with respect to the previous revision,
+// code 400 if the short is invalid,
+// code 404 if the shortlink does not exist and
 // code 500 in case of another error.
-func handleRedirect(c *gin.Context) {
+func (s *server) handleGetHistory(c *gin.Context) {
 	short := c.Param("short")
 	if invalidShort(short, c) {
 		return
 	}
 
-	link, err := GetRedirect(short)
+	shortlink, err := s.store.GetShortlinkByShort(short)
+	if err != nil {
+		if isNotFundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shortlink not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revisions, err := s.store.ListRevisions(shortlink.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	responses, err := revisionResponses(revisions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revisions": responses})
+}
+
+// Handler for GET /shortlinks/:short/events
+// Supports the query parameter limit (default 100, max 1000).
+// Returns code 200 with {events:[..click events..]} of the shortlink, most recent first, on success,
+// code 400 if the short or limit is invalid,
+// code 404 if the shortlink does not exist and
+// code 500 in case of another error.
+func (s *server) handleGetEvents(c *gin.Context) {
+	short := c.Param("short")
+	if invalidShort(short, c) {
+		return
+	}
+	query := &ListQuery{Limit: defaultPageSize}
+	if err := parsePagination(c, query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	shortlink, err := s.store.GetShortlinkByShort(short)
+	if err != nil {
+		if isNotFundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shortlink not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	events, err := s.store.ListEvents(shortlink.ID, query.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// Handler for GET /shortlinks/:short/stats
+// Supports the query parameters bucket (hour, day or week, default day) and
+// from/to (RFC 3339 timestamps, default the 30 days until now), from is aligned to the start of its bucket.
+// Returns code 200 with the click statistics of the shortlink on success,
+// code 400 if the short or a query parameter is invalid or the range spans too many hours,
+// code 404 if the shortlink does not exist and
+// code 500 in case of another error.
+func (s *server) handleGetStats(c *gin.Context) {
+	short := c.Param("short")
+	if invalidShort(short, c) {
+		return
+	}
+	bucket, from, to, err := parseStatsQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	shortlink, err := s.store.GetShortlinkByShort(short)
+	if err != nil {
+		if isNotFundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shortlink not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rollups, err := s.store.ClickRollups(shortlink.ID, bucketStart(from, bucket), to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, clickStats(shortlink, rollups, from, to, bucket))
+}
+
+// Handler for POST /shortlinks/:short/revert/:rev
+// Restores the data of the shortlink, including its short, recorded in the revision `rev`.
+// Returns code 200 with the updated shortlink as json on success,
+// code 400 if the short or revision is invalid,
+// code 404 if the shortlink or revision does not exist,
+// code 409 if the short of the revision is taken by another shortlink and
+// code 500 in case of another error.
+func (s *server) handleRevert(c *gin.Context) {
+	short := c.Param("short")
+	if invalidShort(short, c) {
+		return
+	}
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil || rev < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid revision"})
+		return
+	}
+
+	shortlink, err := s.store.GetShortlinkByShort(short)
+	if err != nil {
+		if isNotFundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shortlink not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revisions, err := s.store.ListRevisions(shortlink.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rev > len(revisions) || revisions[rev-1].Rev != rev {
+		c.JSON(http.StatusNotFound, gin.H{"error": "revision not found"})
+		return
+	}
+
+	// The shortlink may have been loaded by one of its aliases
+	update := revisions[rev-1].Shortlink
+	if update.ShortUrl != shortlink.ShortUrl {
+		err = s.checkReserved(update.ShortUrl)
+	}
+	var savedShortlink *Shortlink
+	if err == nil {
+		savedShortlink, err = s.store.Update(shortlink.ShortUrl, &update)
+	}
+	if err != nil {
+		if isDuplicateError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "shortlink already exists"})
+			return
+		}
+		if isNotFundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shortlink not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.invalidate(savedShortlink)
+	s.recordRevision(c, RevisionRevert, savedShortlink, rev)
+	c.JSON(http.StatusOK, s.response(savedShortlink, c))
+}
+
+// invalidate evicts the changed shortlink from the redirect cache by its ID, which includes
+// its previous shorts and aliases, and cached misses of its current ones.
+// The shorts suggested for missing redirects are evicted as well.
+func (s *server) invalidate(shortlink *Shortlink) {
+	s.shorts.invalidate()
+	if s.cache == nil {
+		return
+	}
+	s.invalidateChange(&ShortlinkChange{ID: shortlink.ID, Shorts: allShorts(shortlink.ShortUrl, shortlink.Aliases)})
+}
+
+// recordRevision records the change of the shortlink made by the request,
+// failures are only logged as the change itself succeeded
+func (s *server) recordRevision(c *gin.Context, action string, shortlink *Shortlink, revertedTo int) {
+	revision := &Revision{
+		ShortlinkID: shortlink.ID,
+		Action:      action,
+		RevertedTo:  revertedTo,
+		Shortlink:   snapshot(shortlink),
+	}
+	if s.config.AuthorHeader != "" {
+		revision.Author = c.GetHeader(s.config.AuthorHeader)
+	}
+	if err := s.store.AddRevision(revision); err != nil {
+		log.Printf("Failed recording revision of shortlink %s: %v", shortlink.ShortUrl, err)
+	}
+}
+
+// Handler for GET and HEAD /go/:short and /go/:short/*rest
+// Returns the redirect type of the shortlink or the configured default, 307 (TemporaryRedirect) by default,
+// to the saved link on success,
+// with placeholders of template links filled from the path segments following the short and
+// the remaining path and the query appended if the shortlink forwards them,
+// code 400 if the shortlink is invalid or arguments of a template link are missing,
+// code 404 with similar shorts as HTML page or json if it doesn't exist,
+// code 404 with the time it becomes active as HTML page or json if it isn't active yet,
+// code 410 (Gone) or a redirect to the configured URL if it expired or reached its maximum number of clicks,
+// code 410 or 451 (Unavailable For Legal Reasons) with the configured message if it is disabled and
+// code 500 in case of another error.
+// HEAD requests don't count as access of the shortlink,
+// redirects of GET requests are counted in memory unless the shortlink has a maximum number of clicks and
+// recorded as click events in the background if enabled.
+// Shortlinks and misses are read from the redirect cache if enabled.
+func (s *server) handleRedirect(c *gin.Context) {
+	short := c.Param("short")
+	if invalidShort(short, c) {
+		return
+	}
+
+	var link *Shortlink
+	var err error
+	if c.Request.Method == http.MethodGet && s.counter == nil && s.cache == nil {
+		link, err = s.store.GetRedirect(short)
+	} else {
+		link, err = s.lookup(short)
+		if err == nil {
+			s.counter.addUnwritten(link)
+			err = link.redirectError(storeTime())
+		}
+		// Shortlinks with a maximum number of clicks are counted by the store to never exceed it
+		if err == nil && c.Request.Method == http.MethodGet {
+			if link.MaxClicks > 0 {
+				link, err = s.store.GetRedirect(short)
+			} else {
+				s.counter.count(link)
+			}
+		}
+	}
 	if err != nil {
 		if isNotFundError(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no redirect for %s", short)})
+			s.redirectNotFound(short, c)
+			return
+		}
+		if isScheduledError(err) {
+			s.redirectScheduled(short, c)
+			return
+		}
+		if isDisabledError(err) {
+			c.JSON(s.config.DisabledStatus, gin.H{"error": s.config.DisabledMessage})
+			return
+		}
+		if isExpiredError(err) {
+			if s.config.ExpiredURL != "" {
+				c.Redirect(s.config.RedirectType, s.config.ExpiredURL)
+				return
+			}
+			c.JSON(http.StatusGone, gin.H{"error": fmt.Sprintf("shortlink %s expired", short)})
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.Redirect(http.StatusTemporaryRedirect, link)
+
+	// Use the escaped path to keep encoded slashes, the short itself never needs escaping
+	rest := strings.TrimPrefix(c.Request.URL.EscapedPath(), "/go/"+short)
+
+	target := link.LongUrl
+	if params := templateParams(link.LongUrl); params != nil {
+		var args []string
+		args, rest = templateArgs(rest, len(params))
+		if len(args) < len(params) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("missing arguments for go/%s", short),
+				"usage": templateUsage(short, params),
+			})
+			return
+		}
+		target = expandTemplate(link.LongUrl, args)
+	}
+	if link.Forward {
+		target, err = forwardURL(target, rest, c.Request.URL.Query())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else if rest != "" && rest != "/" {
+		// Paths are only accepted by shortlinks forwarding them
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no redirect for %s%s", short, c.Param("rest"))})
+		return
+	}
+
+	code := link.RedirectType
+	if code == 0 {
+		code = s.config.RedirectType
+	}
+	if s.events != nil && c.Request.Method == http.MethodGet {
+		s.events.record(c, link, short)
+	}
+	c.Redirect(code, target)
+}
+
+// lookup returns the shortlink to redirect to from the cache if enabled and from the store otherwise
+func (s *server) lookup(short string) (*Shortlink, error) {
+	if s.cache == nil {
+		return s.store.GetShortlinkByShort(short)
+	}
+	return s.cache.load(s.shortKey(short), func() (*Shortlink, error) {
+		return s.store.GetShortlinkByShort(short)
+	})
+}
+
+// redirectNotFound responds with code 404 listing similar shorts,
+// as HTML page if requested by a browser and as json otherwise.
+func (s *server) redirectNotFound(short string, c *gin.Context) {
+	shorts, err := s.shorts.load(s.store.GetAllShorts)
+	if err != nil {
+		log.Printf("Failed receiving shorts for suggestions: %v", err)
+	}
+	suggestions := suggestShorts(short, shorts, maxSuggestions)
+
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) {
+	case gin.MIMEHTML:
+		c.Render(http.StatusNotFound, render.HTML{Template: notFoundPage, Data: gin.H{
+			"Title":       fmt.Sprintf("go/%s not found", short),
+			"Short":       short,
+			"Suggestions": suggestions,
+		}})
+	default:
+		body := gin.H{"error": fmt.Sprintf("no redirect for %s", short)}
+		if len(suggestions) > 0 {
+			body["suggestions"] = suggestions
+		}
+		c.JSON(http.StatusNotFound, body)
+	}
+}
+
+// redirectScheduled responds with code 404 and the time the shortlink becomes active,
+// as HTML page if requested by a browser and as json otherwise.
+func (s *server) redirectScheduled(short string, c *gin.Context) {
+	link, err := s.store.GetShortlinkByShort(short)
+	if err != nil || link.ActiveFrom == nil {
+		// Deleted or changed concurrently
+		s.redirectNotFound(short, c)
+		return
+	}
+
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) {
+	case gin.MIMEHTML:
+		c.Render(http.StatusNotFound, render.HTML{Template: comingSoonPage, Data: gin.H{
+			"Title":      fmt.Sprintf("go/%s is coming soon", short),
+			"Short":      short,
+			"ActiveFrom": link.ActiveFrom.Format(time.RFC1123),
+		}})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":       fmt.Sprintf("shortlink %s is not active yet", short),
+			"active_from": link.ActiveFrom,
+		})
+	}
+}
+
+// Handler for GET /new
+// Returns code 200 with an HTML form to create a shortlink,
+// the short is pre-filled with the query parameter short.
+func (s *server) handleNew(c *gin.Context) {
+	c.Render(http.StatusOK, render.HTML{Template: newPage, Data: gin.H{
+		"Title": "Create a shortlink",
+		"Short": c.Query("short"),
+	}})
 }
 
 // Handler for GET /check/:short
 // Returns code 200 with {free:true} if the shortlink does not exist,
-// code 200 with {free:false} if the shortlink does exist or
+// code 200 with {free:false} if the shortlink does exist or its short is reserved by a deleted shortlink,
 // code 400 if the shortlink is invalid and
 // code 500 in case of another error.
-func handleCheck(c *gin.Context) {
+func (s *server) handleCheck(c *gin.Context) {
 	short := c.Param("short")
 	if invalidShort(short, c) {
 		return
 	}
 
-	free, err := IsFree(short)
+	free, err := s.store.IsFree(short)
+	if err == nil && free {
+		if err = s.checkReserved(short); isDuplicateError(err) {
+			free, err = false, nil
+		}
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -179,14 +742,201 @@ func handleCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"free": free})
 }
 
+// page returns the API representation of the page of shortlinks starting at `offset` of `total` shortlinks
+func (s *server) page(shortlinks []*Shortlink, total int64, offset int, c *gin.Context) *ShortlinkPage {
+	page := &ShortlinkPage{Shortlinks: make([]*ShortlinkResponse, len(shortlinks)), Total: total}
+	for i, shortlink := range shortlinks {
+		page.Shortlinks[i] = s.response(shortlink, c)
+	}
+	if next := offset + len(shortlinks); int64(next) < total {
+		page.NextPageToken = encodePageToken(next)
+	}
+	return page
+}
+
+// response returns the API representation of a shortlink including its redirect URL, state and
+// redirects not yet counted by the store
+func (s *server) response(shortlink *Shortlink, c *gin.Context) *ShortlinkResponse {
+	s.counter.addUnwritten(shortlink)
+	return &ShortlinkResponse{
+		Shortlink: shortlink,
+		Redirect:  s.baseURL(c) + "/go/" + shortlink.ShortUrl,
+		State:     shortlink.state(storeTime()),
+	}
+}
+
+// baseURL returns the configured base URL or the one derived from the request
+func (s *server) baseURL(c *gin.Context) string {
+	if s.config.BaseURL != "" {
+		return strings.TrimSuffix(s.config.BaseURL, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// Default and maximum number of shortlinks per page
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Maximum number of similar shorts suggested if a redirect doesn't exist
+const maxSuggestions = 5
+
+// Default and maximum number of search results
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// parseListQuery reads the query parameters of GET /shortlinks
+func parseListQuery(c *gin.Context) (*ListQuery, error) {
+	query := &ListQuery{
+		Prefix: c.Query("prefix"),
+		Host:   c.Query("host"),
+		Limit:  defaultPageSize,
+	}
+
+	if err := parsePagination(c, query); err != nil {
+		return nil, err
+	}
+
+	if sort := c.Query("sort"); sort != "" {
+		query.Descending = strings.HasPrefix(sort, "-")
+		query.SortBy = strings.TrimPrefix(sort, "-")
+		valid := false
+		for _, field := range SortFields {
+			valid = valid || query.SortBy == field
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid sort, must be one of %s", strings.Join(SortFields, ", "))
+		}
+	}
+
+	if state := c.Query("state"); state != "" {
+		valid := false
+		for _, s := range States {
+			valid = valid || state == s
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid state, must be one of %s", strings.Join(States, ", "))
+		}
+		query.State = state
+	}
+
+	var err error
+	if after := c.Query("created_after"); after != "" {
+		query.CreatedAfter, err = time.Parse(time.RFC3339, after)
+		if err != nil {
+			return nil, errors.New("invalid created_after, must be an RFC 3339 timestamp")
+		}
+	}
+	if before := c.Query("created_before"); before != "" {
+		query.CreatedBefore, err = time.Parse(time.RFC3339, before)
+		if err != nil {
+			return nil, errors.New("invalid created_before, must be an RFC 3339 timestamp")
+		}
+	}
+
+	return query, nil
+}
+
+// Default range of click statistics
+const defaultStatsRange = 30 * 24 * time.Hour
+
+// parseStatsQuery reads the query parameters of GET /shortlinks/:short/stats
+func parseStatsQuery(c *gin.Context) (string, time.Time, time.Time, error) {
+	bucket := c.DefaultQuery("bucket", BucketDay)
+	valid := false
+	for _, b := range Buckets {
+		valid = valid || bucket == b
+	}
+	if !valid {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("invalid bucket, must be one of %s", strings.Join(Buckets, ", "))
+	}
+
+	var err error
+	to := storeTime()
+	if t := c.Query("to"); t != "" {
+		to, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, errors.New("invalid to, must be an RFC 3339 timestamp")
+		}
+	}
+	from := to.Add(-defaultStatsRange)
+	if f := c.Query("from"); f != "" {
+		from, err = time.Parse(time.RFC3339, f)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, errors.New("invalid from, must be an RFC 3339 timestamp")
+		}
+	}
+	if !from.Before(to) {
+		return "", time.Time{}, time.Time{}, errors.New("invalid range, from must be before to")
+	}
+	// Rollups are read from the start of the first bucket
+	if to.Sub(bucketStart(from, bucket)) > maxStatsHours*time.Hour {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("invalid range, must not span more than %d hours", maxStatsHours)
+	}
+	return bucket, from.UTC(), to.UTC(), nil
+}
+
+// parsePagination sets the limit and offset of the query from the query parameters limit and page_token
+func parsePagination(c *gin.Context, query *ListQuery) error {
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxPageSize {
+			return fmt.Errorf("invalid limit, must be between 1 and %d", maxPageSize)
+		}
+		query.Limit = l
+	}
+
+	if token := c.Query("page_token"); token != "" {
+		offset, err := decodePageToken(token)
+		if err != nil {
+			return errors.New("invalid page_token")
+		}
+		query.Offset = offset
+	}
+	return nil
+}
+
+// encodePageToken returns an opaque token for the page starting at `offset`
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// decodePageToken returns the offset of the page represented by `token`
+func decodePageToken(token string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	return offset, nil
+}
+
 /* ********************************************** *\
  * ***************** VALIDATORS ***************** *
 \* ********************************************** */
 
 // The Validators accept a gin Context to which they write StatusBadRequest if the input is invalid.
 
-// invalidURL returns true if the provided string does not represent a valid URL
+// invalidURL returns true if the provided string does not represent a valid URL,
+// template links are checked with their placeholders filled
 func invalidURL(input string, c *gin.Context) bool {
+	if params := templateParams(input); params != nil {
+		args := make([]string, len(params))
+		for i := range args {
+			args[i] = "arg"
+		}
+		input = expandTemplate(input, args)
+	}
 	u, err := url.ParseRequestURI(input)
 	if err != nil || u.Scheme == "" || u.Host == "" {
 		log.Printf("Checked invald url: %v", input)
@@ -207,30 +957,172 @@ func invalidShort(input string, c *gin.Context) bool {
 	return false
 }
 
+// invalidRedirectType returns true if the provided code is neither 0 nor one of RedirectTypes
+func invalidRedirectType(code int, c *gin.Context) bool {
+	if code != 0 && !isRedirectType(code) {
+		log.Printf("Checked invalid redirect type: %v", code)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid redirect type, must be one of %v", RedirectTypes)})
+		return true
+	}
+	return false
+}
+
+// invalidAliases returns true if one of the aliases is an invalid short, equals the short or is repeated,
+// aliases are compared by their `key`
+func invalidAliases(short string, aliases []string, key func(string) string, c *gin.Context) bool {
+	for i, alias := range aliases {
+		m, e := regexp.MatchString("^[a-zA-Z0-9\\-_]+$", alias)
+		if !m || e != nil {
+			log.Printf("Checked invalid alias: %v", alias)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid alias does not match ^[a-zA-Z0-9\\-_]+$"})
+			return true
+		}
+		if key(alias) == key(short) || containsShort(aliases[:i], alias, key) {
+			log.Printf("Checked duplicate alias: %v", alias)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duplicate alias %s", alias)})
+			return true
+		}
+	}
+	return false
+}
+
+// containsShort returns true if `short` is one of the shorts, compared by their `key`
+func containsShort(shorts []string, short string, key func(string) string) bool {
+	for _, s := range shorts {
+		if key(s) == key(short) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortKey returns the key shorts are resolved by, normalized if configured
+func (s *server) shortKey(short string) string {
+	if s.config.NormalizeShorts {
+		return normalizeShort(short)
+	}
+	return short
+}
+
+// invalidMaxClicks returns true if the provided maximum number of clicks is negative
+func invalidMaxClicks(maxClicks int, c *gin.Context) bool {
+	if maxClicks < 0 {
+		log.Printf("Checked invalid max clicks: %v", maxClicks)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid max_clicks, must not be negative"})
+		return true
+	}
+	return false
+}
+
 /* ********************************************** *\
  * **************** SETUP ROUTES **************** *
 \* ********************************************** */
 
-// Setup the gin router
-func setupRoutes() *gin.Engine {
+// Setup the gin router serving shortlinks from the provided store
+func setupRoutes(store Store, config *Config) (*gin.Engine, error) {
+	s, err := newServer(store, config)
+	if err != nil {
+		return nil, err
+	}
+	return s.router(), nil
+}
+
+// newServer validates the settings and returns a server for the store
+func newServer(store Store, config *Config) (*server, error) {
+	generator, err := newShortGenerator(config.GenerateLength, config.GenerateAlphabet)
+	if err != nil {
+		return nil, err
+	}
+	if !isRedirectType(config.RedirectType) {
+		return nil, fmt.Errorf("invalid redirect type %d, must be one of %v", config.RedirectType, RedirectTypes)
+	}
+	if config.DisabledStatus != http.StatusGone && config.DisabledStatus != http.StatusUnavailableForLegalReasons {
+		return nil, fmt.Errorf("invalid status %d for disabled shortlinks, must be 410 or 451", config.DisabledStatus)
+	}
+	if u, err := url.ParseRequestURI(config.ExpiredURL); config.ExpiredURL != "" && (err != nil || u.Host == "") {
+		return nil, fmt.Errorf("invalid URL for expired shortlinks %q", config.ExpiredURL)
+	}
+	if !isWatchMode(config.CacheWatch) {
+		return nil, fmt.Errorf("invalid cache watch mode %q, must be one of %v", config.CacheWatch, WatchModes)
+	}
+	if config.CacheWatch != WatchOff && config.CachePollInterval <= 0 {
+		return nil, fmt.Errorf("invalid cache poll interval %d, must be positive", config.CachePollInterval)
+	}
+	// Redirects counted by the store read the shortlink anyway, the cache would only add a lookup
+	if config.RedirectCacheSize > 0 && config.AccessCountInterval <= 0 {
+		return nil, fmt.Errorf("redirect cache requires access counts in memory, set an access count interval")
+	}
+	// Record the operations of the store, including those of the access counter and the event log
+	metrics := newMetrics()
+	store = metrics.instrument(store)
+	s := &server{store: store, config: config, generator: generator, metrics: metrics}
+	if config.RecordEvents {
+		s.events, err = newEventLog(store, config.EventIPKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.AccessCountInterval > 0 {
+		s.counter = newAccessCounter(store, time.Duration(config.AccessCountInterval)*time.Millisecond)
+	}
+	if config.RedirectCacheSize > 0 {
+		s.cache = newRedirectCache(config.RedirectCacheSize,
+			time.Duration(config.RedirectCacheTTL)*time.Second, time.Duration(config.RedirectCacheMissTTL)*time.Second)
+	}
+	metrics.observeShortlinks(store)
+	metrics.observeCache(s.cache)
+	return s, nil
+}
+
+// Close writes the access counts and click events of redirects not yet written to the store
+func (s *server) Close() {
+	if s.counter != nil {
+		s.counter.Flush()
+	}
+	if s.events != nil {
+		s.events.Close()
+	}
+}
+
+// router returns the gin router serving all routes of the server
+func (s *server) router() *gin.Engine {
 	router := gin.Default()
+	router.Use(s.metrics.middleware)
 
 	// Optionally set CORS to allow all origins.
 	// See https://github.com/gin-contrib/cors
 	// router.Use(cors.Default())
 
 	// Redirect service
-	router.GET("/go/:short", handleRedirect)
+	router.GET("/go/:short", s.handleRedirect)
+	router.GET("/go/:short/*rest", s.handleRedirect)
+	router.HEAD("/go/:short", s.handleRedirect)
+	router.HEAD("/go/:short/*rest", s.handleRedirect)
 
 	// CRUD operations
-	router.GET("/shortlinks", handleGetShortlinks)
-	router.GET("/shortlinks/:short", handleGetShortlink)
-	router.PUT("/shortlinks/:short", handleUpdateShortlink)
-	router.POST("/shortlinks", handleCreateShortlink)
-	router.DELETE("/shortlinks/:short", handleDeleteShortlink)
+	router.GET("/shortlinks", s.handleGetShortlinks)
+	router.GET("/shortlinks/search", s.handleSearch)
+	router.GET("/shortlinks/:short", s.handleGetShortlink)
+	router.PUT("/shortlinks/:short", s.handleUpdateShortlink)
+	router.POST("/shortlinks", s.handleCreateShortlink)
+	router.DELETE("/shortlinks/:short", s.handleDeleteShortlink)
+	router.GET("/shortlinks/:short/history", s.handleGetHistory)
+	router.POST("/shortlinks/:short/revert/:rev", s.handleRevert)
+	router.GET("/shortlinks/:short/events", s.handleGetEvents)
+	router.GET("/shortlinks/:short/stats", s.handleGetStats)
+
+	// Deleted shortlinks
+	router.GET("/trash", s.handleGetTrash)
+	router.POST("/trash/:short/restore", s.handleRestore)
+
+	// Form to create shortlinks in the browser
+	router.GET("/new", s.handleNew)
 
 	// Checking for free redirects
-	router.GET("/check/:short", handleCheck)
+	router.GET("/check/:short", s.handleCheck)
+
+	// Prometheus metrics
+	router.GET("/metrics", gin.WrapH(s.metrics.handler()))
 
 	// Serve swagger-ui if ./swagger-dist exists.
 	if _, err := os.Stat("swagger-dist"); !os.IsNotExist(err) {
@@ -244,17 +1136,180 @@ func setupRoutes() *gin.Engine {
  * **************** MAIN FUNCTION *************** *
 \* ********************************************** */
 
-// Main function, connects to the MongoDB and sets up the router
+// openStore opens the store selected by SHORTY_STORE:
+// `mongo` (default) connects to the MongoDB configured via MONGO_URL, SHORTY_DB and SHORTY_COLLECTION,
+// `postgres` (default if POSTGRES_DSN is set) connects to the PostgreSQL database POSTGRES_DSN,
+// `sqlite` opens the SQLite database file SHORTY_SQLITE_PATH (defaults to shorty.db) and
+// `memory` keeps all shortlinks in memory.
+// The schema of SQL databases is migrated to the latest version.
+// MongoDB deletes expired shortlinks via a TTL index if the config purges them.
+func openStore(config *Config) (Store, error) {
+	var store Store
+	var err error
+	switch backend := storeBackend(); backend {
+	case "mongo":
+		store, err = Connect(MongoConfig{
+			URL:        os.Getenv("MONGO_URL"),
+			Database:   os.Getenv("SHORTY_DB"),
+			Collection: os.Getenv("SHORTY_COLLECTION"),
+			ExpireTTL:  config.PurgeInterval > 0,
+		})
+	case "postgres":
+		store, err = OpenPostgres(os.Getenv("POSTGRES_DSN"))
+	case "sqlite":
+		store, err = OpenSQLite(sqlitePath())
+	case "memory":
+		store = NewMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown store %q", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.SetNormalizeShorts(config.NormalizeShorts); err != nil {
+		store.Close()
+		if isDuplicateError(err) {
+			return nil, errors.New("can't normalize shorts, some existing shorts only differ in case or separators")
+		}
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrate connects to the SQL store selected by SHORTY_STORE and migrates
+// the schema to the version given as argument or the latest version.
+func migrate(args []string) error {
+	var store *SQLStore
+	var err error
+	switch backend := storeBackend(); backend {
+	case "postgres":
+		store, err = ConnectPostgres(os.Getenv("POSTGRES_DSN"))
+	case "sqlite":
+		store, err = ConnectSQLite(sqlitePath())
+	default:
+		return fmt.Errorf("store %q does not support migrations", backend)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	target := latestVersion(store.dialect.migrations)
+	if len(args) > 0 {
+		target, err = strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid schema version %q", args[0])
+		}
+	}
+	if err := store.Migrate(target); err != nil {
+		return err
+	}
+	log.Printf("Migrated schema to version %d", target)
+	return nil
+}
+
+// storeBackend returns the configured store backend
+func storeBackend() string {
+	backend := os.Getenv("SHORTY_STORE")
+	if backend == "" {
+		backend = "mongo"
+		if os.Getenv("POSTGRES_DSN") != "" {
+			backend = "postgres"
+		}
+	}
+	return backend
+}
+
+// sqlitePath returns the configured SQLite database file
+func sqlitePath() string {
+	path := os.Getenv("SHORTY_SQLITE_PATH")
+	if path == "" {
+		path = "shorty.db"
+	}
+	return path
+}
+
+// Main function, connects to the database and sets up the router
 func main() {
-	// Connect to the MongoDB
-	err := Connect()
+	// Run `shorty migrate [version]` to only migrate the schema of an SQL store
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Read the settings
+	config, err := ConfigFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Setup the routes
-	router := setupRoutes()
+	// Connect to the database
+	store, err := openStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Periodically purge expired shortlinks if configured
+	stopReaper := func() {}
+	if config.PurgeInterval > 0 {
+		stopReaper = startReaper(store, time.Duration(config.PurgeInterval)*time.Second)
+	}
+
+	// Permanently delete shortlinks from the trash after the retention period
+	stopTrashReaper := func() {}
+	if config.TrashRetention > 0 {
+		stopTrashReaper = startTrashReaper(store, time.Duration(config.TrashRetention)*time.Second)
+	}
+
+	// Delete click events after the retention period
+	stopEventReaper := func() {}
+	if config.EventRetention > 0 {
+		stopEventReaper = startEventReaper(store, time.Duration(config.EventRetention)*time.Second)
+	}
+
+	s, err := newServer(store, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Evict shortlinks changed by other instances of the service from the redirect cache
+	stopCacheWatcher := s.startCacheWatcher()
 
 	// listen and serve on port 8080 unless PORT is set
-	router.Run()
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	srv := &http.Server{Addr: ":" + port, Handler: s.router()}
+
+	// Setup a hook on SIGTERM/SIGINT to stop accepting requests and finish the running ones
+	shutdown := make(chan struct{})
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		ctx, cancel := TimedContext()
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Could not finish all requests: %v", err)
+		}
+		close(shutdown)
+	}()
+
+	log.Printf("Listening and serving HTTP on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
+
+	// Write pending access counts and click events and close the store before exiting
+	stopReaper()
+	stopTrashReaper()
+	stopEventReaper()
+	stopCacheWatcher()
+	s.Close()
+	store.Close()
 }
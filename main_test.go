@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -12,6 +19,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/suite"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 /* ********************************************** *
@@ -21,40 +30,108 @@ import (
 // Struct for the test suite
 type S struct {
 	suite.Suite
-	suite.SetupAllSuite
 	suite.SetupTestSuite
-	suite.TearDownAllSuite
-	router *gin.Engine
+	suite.TearDownTestSuite
+	// Opens an empty store before each test
+	newStore func() (Store, error)
+	store    Store
+	server   *server
+	router   *gin.Engine
 }
 
-// Setup the database and routes before the suite is executed
-func (s *S) SetupSuite() {
-	fmt.Println("In SetupSuite")
-	default_db = "testing"
-	default_collection = "test"
-	err := Connect()
+// Setup an empty store and the routes before each test
+func (s *S) SetupTest() {
+	store, err := s.newStore()
+	if err != nil {
+		s.FailNow("Error opening store", err)
+	}
+	s.store = store
+	s.server, err = newServer(store, DefaultConfig())
 	if err != nil {
-		s.Fail("Error connecting: %v", err)
+		s.FailNow("Error setting up routes", err)
 	}
-	s.router = setupRoutes()
+	s.router = s.server.router()
 }
 
-// Before each test in the suite delete all documents
-func (s *S) SetupTest() {
-	coll.DeleteMany(UnboundContext(), bson.M{})
+// After each test write pending access counts and click events and close the store
+func (s *S) TearDownTest() {
+	s.server.Close()
+	s.store.Close()
 }
 
-// After all tests are done cleanup
-func (s *S) TearDownSuite() {
-	// Drop the test database
-	coll.Database().Drop(UnboundContext())
-	// Disconnect
-	coll.Database().Client().Disconnect(UnboundContext())
+// Register the suite to be run by go test against the MemoryStore
+func TestShortyTestSuite(t *testing.T) {
+	suite.Run(t, &S{newStore: func() (Store, error) {
+		return NewMemoryStore(), nil
+	}})
 }
 
-// Register the suite to be run by go test
-func TestShortyTestSuite(t *testing.T) {
-	suite.Run(t, new(S))
+// Register the suite to be run against an in-memory SQLite database
+func TestShortySQLiteSuite(t *testing.T) {
+	suite.Run(t, &S{newStore: func() (Store, error) {
+		return OpenSQLite(":memory:")
+	}})
+}
+
+// Register the suite to be run against PostgreSQL if POSTGRES_DSN is set.
+// All shortlinks in the database, its trash, revisions, click events and statistics are deleted before each test.
+func TestShortyPostgresSuite(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set, skipping PostgreSQL integration tests")
+	}
+	suite.Run(t, &S{newStore: func() (Store, error) {
+		store, err := OpenPostgres(dsn)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = store.db.Exec("DELETE FROM shortlinks"); err != nil {
+			return nil, err
+		}
+		if _, err = store.db.Exec("DELETE FROM trash"); err != nil {
+			return nil, err
+		}
+		if _, err = store.db.Exec("DELETE FROM revisions"); err != nil {
+			return nil, err
+		}
+		for _, table := range []string{"events", "click_stats", "click_counts"} {
+			if _, err = store.db.Exec("DELETE FROM " + table); err != nil {
+				return nil, err
+			}
+		}
+		return store, nil
+	}})
+}
+
+// Register the suite to be run against MongoDB if MONGO_URL is set.
+// Uses the collection `test` in the database `testing`.
+func TestShortyMongoSuite(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("MONGO_URL not set, skipping MongoDB integration tests")
+	}
+	suite.Run(t, &S{newStore: func() (Store, error) {
+		store, err := Connect(MongoConfig{URL: url, Database: "testing", Collection: "test"})
+		if err != nil {
+			return nil, err
+		}
+		// Delete all documents left over from previous tests
+		if _, err = store.coll.DeleteMany(UnboundContext(), bson.M{}); err != nil {
+			return nil, err
+		}
+		if _, err = store.trash.DeleteMany(UnboundContext(), bson.M{}); err != nil {
+			return nil, err
+		}
+		if _, err = store.revisions.DeleteMany(UnboundContext(), bson.M{}); err != nil {
+			return nil, err
+		}
+		for _, coll := range []*mongo.Collection{store.events, store.stats, store.counts} {
+			if _, err = coll.DeleteMany(UnboundContext(), bson.M{}); err != nil {
+				return nil, err
+			}
+		}
+		return store, nil
+	}})
 }
 
 /* ********************************************** *
@@ -71,6 +148,70 @@ func (s *S) TestCreateValid() {
 	s.Equal(201, c)
 }
 
+func (s *S) TestCreateReturnsShortlink() {
+	sl := exampleShortlink()
+
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	r := unmarshalShortlink(b)
+
+	s.Equal(201, c)
+	s.Equal(sl.Description, r.Description, b)
+	s.Equal(sl.ShortUrl, r.ShortUrl, b)
+	s.Equal(sl.LongUrl, r.LongUrl, b)
+	s.Equal(0, r.AccessCount, b)
+}
+
+func (s *S) TestCreateLocation() {
+	resp := s.send("POST", "/shortlinks", `{"short":"ex","long":"http://example.com"}`)
+
+	s.Equal(201, resp.Code)
+	s.Equal("/shortlinks/ex", resp.Header().Get("Location"))
+	s.Contains(resp.Body.String(), `"redirect":"http://shorty.test/go/ex"`)
+
+	c, _ := s.request("GET", resp.Header().Get("Location"), "")
+	s.Equal(200, c)
+}
+
+func (s *S) TestCreateGenerated() {
+	c, b := s.request("POST", "/shortlinks", `{"long":"http://example.com"}`)
+	s.Equal(201, c)
+
+	r := unmarshalShortlink(b)
+	s.Regexp("^[a-zA-Z0-9]{6}$", r.ShortUrl, b)
+	s.Equal("http://example.com", r.LongUrl, b)
+
+	c, _ = s.request("GET", fmt.Sprintf("/shortlinks/%s", r.ShortUrl), "")
+	s.Equal(200, c)
+}
+
+func (s *S) TestCreateGeneratedPronounceable() {
+	config := DefaultConfig()
+	config.GenerateAlphabet = "pronounceable"
+	s.router, _ = setupRoutes(s.store, config)
+
+	c, b := s.request("POST", "/shortlinks", `{"long":"http://example.com"}`)
+	s.Equal(201, c)
+	s.Regexp("^([^aeiou][aeiou]){3}$", unmarshalShortlink(b).ShortUrl, b)
+}
+
+func (s *S) TestCreateGeneratedRetries() {
+	config := DefaultConfig()
+	config.GenerateLength = 1
+	config.GenerateAlphabet = "ab"
+	config.GenerateAttempts = 100
+	s.router, _ = setupRoutes(s.store, config)
+
+	c, b := s.request("POST", "/shortlinks", `{"long":"http://example.com"}`)
+	s.Equal(201, c, b)
+	c, b = s.request("POST", "/shortlinks", `{"long":"http://example.com"}`)
+	s.Equal(201, c, b)
+
+	// Both shorts are taken now
+	c, b = s.request("POST", "/shortlinks", `{"long":"http://example.com"}`)
+	s.Equal(http.StatusConflict, c)
+	s.Equal(`{"error":"could not generate a free short"}`, b)
+}
+
 func (s *S) TestCreateDuplicate() {
 	sl := exampleShortlink()
 
@@ -231,205 +372,1990 @@ func (s *S) TestDeleteInvalid() {
 	s.Equal(`{"error":"invalid short does not match ^[a-zA-Z0-9\\-_]+$"}`, b)
 }
 
-/* TESTS FOR GET ALL */
+func (s *S) TestDeleteMovesToTrash() {
+	s.createShortlinks("first", "second")
+	s.Equal(200, s.send("DELETE", "/shortlinks/first", "").Code)
+	s.Equal(200, s.send("DELETE", "/shortlinks/second", "").Code)
 
-func (s *S) TestGetAllEmpty() {
-	c, b := s.request("GET", "/shortlinks", "")
+	c, _ := s.request("GET", "/shortlinks/first", "")
+	s.Equal(404, c)
+	c, _ = s.request("GET", "/go/first", "")
+	s.Equal(404, c)
+
+	c, b := s.request("GET", "/trash", "")
+	s.Equal(200, c)
+	page := unmarshalShortlinkPage(b)
+	s.Equal([]string{"second", "first"}, shortsOf(page))
+	s.Equal(int64(2), page.Total)
+	s.NotNil(page.Shortlinks[0].DeletedAt)
+	s.Contains(b, `"state":"deleted"`)
 
+	c, b = s.request("GET", "/trash?limit=1", "")
 	s.Equal(200, c)
-	s.Equal(`[]`, b)
+	page = unmarshalShortlinkPage(b)
+	s.Equal([]string{"second"}, shortsOf(page))
+	s.NotEmpty(page.NextPageToken)
 }
 
-func (s *S) TestGetAllOne() {
+func (s *S) TestRestore() {
 	sl := exampleShortlink()
-	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	c, b := s.requestSL("POST", "/shortlinks", sl)
 	s.Equal(201, c)
+	created := unmarshalShortlink(b)
+	s.Equal(200, s.send("DELETE", "/shortlinks/"+sl.ShortUrl, "").Code)
 
-	c, b := s.request("GET", "/shortlinks", "")
-	r := unmarshalShortlinkArray(b)
+	// Restores are changes polled by their update time
+	time.Sleep(5 * time.Millisecond)
+	c, b = s.request("POST", "/trash/"+sl.ShortUrl+"/restore", "")
+	s.Equal(200, c)
+	r := unmarshalShortlink(b)
+	s.Equal(sl.ShortUrl, r.ShortUrl)
+	s.Equal(sl.LongUrl, r.LongUrl)
+	s.Nil(r.DeletedAt)
+	s.True(r.UpdatedAt.After(created.UpdatedAt), "%v not after %v", r.UpdatedAt, created.UpdatedAt)
+	c, b = s.request("GET", "/shortlinks/"+sl.ShortUrl, "")
+	s.Equal(200, c)
+	s.Equal(r.UpdatedAt, unmarshalShortlink(b).UpdatedAt)
 
+	s.Equal(307, s.send("GET", "/go/"+sl.ShortUrl, "").Code)
+	c, b = s.request("GET", "/trash", "")
 	s.Equal(200, c)
+	s.Empty(shortsOf(unmarshalShortlinkPage(b)))
 
-	s.Equal(sl.Description, r[0].Description, b)
-	s.Equal(sl.ShortUrl, r[0].ShortUrl, b)
-	s.Equal(sl.LongUrl, r[0].LongUrl, b)
+	c, b = s.request("POST", "/trash/"+sl.ShortUrl+"/restore", "")
+	s.Equal(404, c)
+	s.Equal(`{"error":"shortlink not found in trash"}`, b)
 }
 
-/* TESTS FOR CHECK */
+func (s *S) TestRestoreConflict() {
+	s.createShortlinks("taken")
+	s.Equal(200, s.send("DELETE", "/shortlinks/taken", "").Code)
+	s.createShortlinks("taken")
 
-func (s *S) TestCheckNotExisting() {
-	c, b := s.request("GET", "/check/something", "")
+	c, b := s.request("POST", "/trash/taken/restore", "")
+	s.Equal(409, c)
+	s.Equal(`{"error":"shortlink already exists"}`, b)
 
+	c, b = s.request("GET", "/trash", "")
 	s.Equal(200, c)
-	s.Equal(`{"free":true}`, b)
+	s.Equal([]string{"taken"}, shortsOf(unmarshalShortlinkPage(b)))
 }
-func (s *S) TestCheckExistent() {
-	sl := exampleShortlink()
-	c, _ := s.requestSL("POST", "/shortlinks", sl)
-	s.Equal(201, c)
 
-	c, b := s.request("GET", fmt.Sprintf("/check/%s", sl.ShortUrl), "")
+func (s *S) TestReserveDeletedShorts() {
+	config := DefaultConfig()
+	config.ReserveDeletedShorts = true
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+
+	s.createShortlinks("reserved", "other")
+	s.Equal(200, s.send("DELETE", "/shortlinks/reserved", "").Code)
 
+	c, b := s.request("GET", "/check/reserved", "")
 	s.Equal(200, c)
 	s.Equal(`{"free":false}`, b)
-}
 
-func (s *S) TestCheckInvalid() {
-	c, b := s.request("GET", "/check/käse", "")
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "reserved", LongUrl: "http://example.com"})
+	s.Equal(409, c)
+	c, _ = s.requestSL("PUT", "/shortlinks/other", ShortlinkUpdate{ShortUrl: "reserved", LongUrl: "http://example.com"})
+	s.Equal(409, c)
 
-	s.Equal(400, c)
-	s.Equal(`{"error":"invalid short does not match ^[a-zA-Z0-9\\-_]+$"}`, b)
+	purged, err := s.store.PurgeTrash(now().Add(time.Second))
+	s.NoError(err)
+	s.Equal(int64(1), purged)
+
+	c, b = s.request("GET", "/check/reserved", "")
+	s.Equal(200, c)
+	s.Equal(`{"free":true}`, b)
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "reserved", LongUrl: "http://example.com"})
+	s.Equal(201, c)
 }
 
-/* TEST FOR REDIRECT */
+func (s *S) TestPurgeTrash() {
+	s.createShortlinks("old", "new")
+	s.Equal(200, s.send("DELETE", "/shortlinks/old", "").Code)
+	time.Sleep(10 * time.Millisecond)
+	between := now()
+	time.Sleep(10 * time.Millisecond)
+	s.Equal(200, s.send("DELETE", "/shortlinks/new", "").Code)
 
-func (s *S) TestRedirectNotExisting() {
-	c, b := s.request("GET", "/go/somewhere", "")
+	purged, err := s.store.PurgeTrash(between)
+	s.NoError(err)
+	s.Equal(int64(1), purged)
 
-	s.Equal(404, c)
-	s.Equal(`{"error":"no redirect for somewhere"}`, b)
+	c, b := s.request("GET", "/trash", "")
+	s.Equal(200, c)
+	s.Equal([]string{"new"}, shortsOf(unmarshalShortlinkPage(b)))
 }
 
-func (s *S) TestRedirectExisting() {
-	sl := exampleShortlink()
-	c, _ := s.requestSL("POST", "/shortlinks", sl)
+/* TESTS FOR ALIASES */
+
+func (s *S) TestAliasRedirect() {
+	sl := ShortlinkUpdate{ShortUrl: "oncall", LongUrl: "http://example.com/oncall", Aliases: []string{"pager", "on-call"}}
+	c, b := s.requestSL("POST", "/shortlinks", sl)
 	s.Equal(201, c)
+	s.Equal([]string{"pager", "on-call"}, unmarshalShortlink(b).Aliases)
 
-	c, b := s.request("GET", fmt.Sprintf("/go/%s", sl.ShortUrl), "")
+	for _, short := range []string{"oncall", "pager", "on-call"} {
+		resp := s.send("GET", "/go/"+short, "")
+		s.Equal(307, resp.Code, short)
+		s.Equal("http://example.com/oncall", resp.Header().Get("Location"), short)
+	}
 
-	s.Equal(307, c)
-	s.Equal(fmt.Sprintf("<a href=\"%s\">Temporary Redirect</a>.\n\n", sl.LongUrl), b)
+	c, b = s.request("GET", "/shortlinks/pager", "")
+	s.Equal(200, c)
+	r := unmarshalShortlink(b)
+	s.Equal("oncall", r.ShortUrl)
+	s.Equal(3, r.AccessCount)
 }
 
-func (s *S) TestRedirectInvalid() {
-	c, b := s.request("GET", "/go/käse", "")
-
-	s.Equal(400, c)
-	s.Equal(`{"error":"invalid short does not match ^[a-zA-Z0-9\\-_]+$"}`, b)
-}
+func (s *S) TestAliasUnique() {
+	c, _ := s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "oncall", LongUrl: "http://example.com", Aliases: []string{"pager"}})
+	s.Equal(201, c)
 
-/* ********************************************** *
- * *************** BEHAVIOR TESTS *************** *
- * ********************************************** */
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "pager", LongUrl: "http://example.com"})
+	s.Equal(409, c)
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "other", LongUrl: "http://example.com", Aliases: []string{"oncall"}})
+	s.Equal(409, c)
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "other", LongUrl: "http://example.com", Aliases: []string{"pager"}})
+	s.Equal(409, c)
 
-// Check that redirects increment the access_count and that it is preserved by update
-func (s *S) TestRedirectCount() {
-	sl := exampleShortlink()
-	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "other", LongUrl: "http://example.com"})
 	s.Equal(201, c)
+	c, _ = s.requestSL("PUT", "/shortlinks/other", ShortlinkUpdate{ShortUrl: "other", LongUrl: "http://example.com", Aliases: []string{"pager"}})
+	s.Equal(409, c)
+	c, _ = s.requestSL("PUT", "/shortlinks/other", ShortlinkUpdate{ShortUrl: "pager", LongUrl: "http://example.com"})
+	s.Equal(409, c)
 
-	c, b := s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	c, b := s.request("GET", "/check/pager", "")
 	s.Equal(200, c)
-	r := unmarshalShortlink(b)
-	s.Equal(0, r.AccessCount)
+	s.Equal(`{"free":false}`, b)
+}
 
-	c, b = s.request("GET", fmt.Sprintf("/go/%s", sl.ShortUrl), "")
-	s.Equal(307, c)
-	s.Equal(fmt.Sprintf("<a href=\"%s\">Temporary Redirect</a>.\n\n", sl.LongUrl), b)
+func (s *S) TestAliasReleased() {
+	c, _ := s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "oncall", LongUrl: "http://example.com", Aliases: []string{"pager", "on-call"}})
+	s.Equal(201, c)
 
-	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	// Swapping the short with an alias and dropping the other one
+	c, b := s.requestSL("PUT", "/shortlinks/oncall", ShortlinkUpdate{ShortUrl: "pager", LongUrl: "http://example.com", Aliases: []string{"oncall"}})
 	s.Equal(200, c)
-	r = unmarshalShortlink(b)
-	s.Equal(1, r.AccessCount)
+	s.Equal([]string{"oncall"}, unmarshalShortlink(b).Aliases)
+	s.Equal(404, s.send("GET", "/go/on-call", "").Code)
+	s.Equal(307, s.send("GET", "/go/oncall", "").Code)
 
-	s.request("GET", fmt.Sprintf("/go/%s", sl.ShortUrl), "")
-	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, s.send("DELETE", "/shortlinks/pager", "").Code)
+	c, b = s.request("GET", "/check/oncall", "")
 	s.Equal(200, c)
-	r = unmarshalShortlink(b)
-	s.Equal(2, r.AccessCount)
+	s.Equal(`{"free":true}`, b)
 
-	oldshort := sl.ShortUrl
-	sl.ShortUrl = "newurl"
-	c, b = s.requestSL("PUT", fmt.Sprintf("/shortlinks/%s", oldshort), sl)
-	s.Equal(200, c)
-	r = unmarshalShortlink(b)
+	s.createShortlinks("oncall")
+	c, _ = s.request("POST", "/trash/pager/restore", "")
+	s.Equal(409, c)
+}
 
-	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+// Check that shortlinks can be updated and deleted via their aliases
+func (s *S) TestAliasUpdateDelete() {
+	c, _ := s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "ex", LongUrl: "http://example.com", Aliases: []string{"al"}})
+	s.Equal(201, c)
+
+	c, b := s.requestSL("PUT", "/shortlinks/al", ShortlinkUpdate{ShortUrl: "ex", LongUrl: "http://example.com/updated", Aliases: []string{"al"}})
+	s.Equal(200, c, b)
+	s.Equal("http://example.com/updated", unmarshalShortlink(b).LongUrl)
+	s.Equal("http://example.com/updated", s.send("GET", "/go/ex", "").Header().Get("Location"))
+
+	c, b = s.request("DELETE", "/shortlinks/al", "")
 	s.Equal(200, c)
-	r = unmarshalShortlink(b)
-	s.Equal(2, r.AccessCount)
+	s.Equal(`{"deleted":1}`, b)
+	s.Equal(404, s.send("GET", "/go/ex", "").Code)
+	s.Equal(404, s.send("GET", "/go/al", "").Code)
 }
 
-// Check the created and updated times
-func (s *S) TestUpdateTimes() {
-	start := now()
+func (s *S) TestAliasInvalid() {
 	sl := exampleShortlink()
-	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	sl.Aliases = []string{"käse"}
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid alias does not match ^[a-zA-Z0-9\\-_]+$"}`, b)
+
+	sl.Aliases = []string{"other", "other"}
+	c, b = s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(400, c)
+	s.Equal(`{"error":"duplicate alias other"}`, b)
+
+	sl.Aliases = []string{sl.ShortUrl}
+	c, b = s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(400, c)
+	s.Equal(`{"error":"duplicate alias ex"}`, b)
+}
+
+/* TESTS FOR NORMALIZED SHORTS */
+
+// Enables normalizing shorts in the store and the routes
+func (s *S) normalizeShorts() {
+	s.Require().NoError(s.store.SetNormalizeShorts(true))
+	config := DefaultConfig()
+	config.NormalizeShorts = true
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+}
+
+func (s *S) TestNormalizeShorts() {
+	c, _ := s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "On_Call", LongUrl: "http://example.com", Aliases: []string{"Pager"}})
 	s.Equal(201, c)
+	s.Equal(404, s.send("GET", "/go/on-call", "").Code)
 
-	c, b := s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.normalizeShorts()
+	for _, short := range []string{"On_Call", "on-call", "ON_CALL", "pager", "PAGER"} {
+		s.Equal(307, s.send("GET", "/go/"+short, "").Code, short)
+	}
+
+	c, b := s.request("GET", "/shortlinks/on-call", "")
 	s.Equal(200, c)
 	r := unmarshalShortlink(b)
+	s.Equal("On_Call", r.ShortUrl)
+	s.Equal([]string{"Pager"}, r.Aliases)
 
-	created := r.CreatedAt
-	s.True(before(start, created))
-	s.True(before(created, now()))
+	c, b = s.request("GET", "/check/oN-cAlL", "")
+	s.Equal(200, c)
+	s.Equal(`{"free":false}`, b)
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "on-call", LongUrl: "http://example.com"})
+	s.Equal(409, c)
+	c, _ = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "other", LongUrl: "http://example.com", Aliases: []string{"PAGER"}})
+	s.Equal(409, c)
 
-	updated := r.UpdatedAt
-	s.True(before(start, updated))
-	s.True(before(updated, now()))
+	c, b = s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "other", LongUrl: "http://example.com", Aliases: []string{"Other"}})
+	s.Equal(400, c)
+	s.Equal(`{"error":"duplicate alias Other"}`, b)
+}
 
-	start_update := now()
-	oldshort := sl.ShortUrl
-	sl.ShortUrl = "newurl"
-	c, b = s.requestSL("PUT", fmt.Sprintf("/shortlinks/%s", oldshort), sl)
-	s.Equal(200, c)
-	r = unmarshalShortlink(b)
+// Check that shortlinks can be updated and deleted via their normalized shorts and aliases
+func (s *S) TestNormalizeShortsUpdateDelete() {
+	s.normalizeShorts()
+	c, _ := s.requestSL("POST", "/shortlinks", ShortlinkUpdate{ShortUrl: "On_Call", LongUrl: "http://example.com", Aliases: []string{"Pager"}})
+	s.Equal(201, c)
 
-	s.Equal(created, r.CreatedAt)
+	c, b := s.requestSL("PUT", "/shortlinks/on-call", ShortlinkUpdate{ShortUrl: "On_Call", LongUrl: "http://example.com/updated", Aliases: []string{"Pager"}})
+	s.Equal(200, c, b)
+	s.Equal("On_Call", unmarshalShortlink(b).ShortUrl)
+	s.Equal("http://example.com/updated", s.send("GET", "/go/ON-CALL", "").Header().Get("Location"))
 
-	updated = r.UpdatedAt
-	s.True(before(start_update, updated))
-	s.True(before(updated, now()))
+	c, b = s.requestSL("PUT", "/shortlinks/PAGER", ShortlinkUpdate{ShortUrl: "on-call", LongUrl: "http://example.com/updated"})
+	s.Equal(200, c, b)
+	s.Equal("on-call", unmarshalShortlink(b).ShortUrl)
+	s.Equal(404, s.send("GET", "/go/pager", "").Code)
 
-	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	c, b = s.request("DELETE", "/shortlinks/ON_CALL", "")
 	s.Equal(200, c)
-	r2 := unmarshalShortlink(b)
-	s.Equal(r, r2)
+	s.Equal(`{"deleted":1}`, b)
+	s.Equal(404, s.send("GET", "/go/on-call", "").Code)
 }
 
-/* ********************************************** *
- * ************** HELPER FUNCTIONS ************** *
- * ********************************************** */
+func (s *S) TestNormalizeShortsConflict() {
+	s.createShortlinks("OnCall", "oncall")
 
-// Send a request with the given method/url/body and return the status code and body
-func (s *S) requestSL(method string, url string, body ShortlinkUpdate) (int, string) {
-	b, err := json.Marshal(body)
-	if err != nil {
-		s.Fail("Failed creating request", err)
+	s.True(isDuplicateError(s.store.SetNormalizeShorts(true)))
+	s.NoError(s.store.SetNormalizeShorts(false))
+	s.Equal(307, s.send("GET", "/go/OnCall", "").Code)
+}
+
+/* TESTS FOR HISTORY */
+
+func (s *S) TestHistory() {
+	sl := exampleShortlink()
+	header := http.Header{"X-Forwarded-User": []string{"alice"}}
+	b, _ := json.Marshal(sl)
+	s.Equal(201, s.sendHeader("POST", "/shortlinks", string(b), header).Code)
+
+	sl.ShortUrl = "renamed"
+	sl.Description = "Renamed"
+	c, _ := s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Equal(200, s.send("DELETE", "/shortlinks/renamed", "").Code)
+	s.Equal(200, s.send("POST", "/trash/renamed/restore", "").Code)
+
+	c, b2 := s.request("GET", "/shortlinks/renamed/history", "")
+	s.Equal(200, c)
+	var history struct {
+		Revisions []struct {
+			Rev     int    `json:"rev"`
+			Action  string `json:"action"`
+			Author  string `json:"author"`
+			Short   string `json:"short"`
+			Changes map[string]Change
+		} `json:"revisions"`
 	}
-	return s.request(method, url, string(b))
+	s.NoError(json.Unmarshal([]byte(b2), &history))
+	s.Len(history.Revisions, 4)
+
+	created := history.Revisions[0]
+	s.Equal(1, created.Rev)
+	s.Equal(RevisionCreate, created.Action)
+	s.Equal("alice", created.Author)
+	s.Equal("ex", created.Short)
+	s.Equal(Change{From: "", To: "ex"}, created.Changes["short"])
+
+	updated := history.Revisions[1]
+	s.Equal(RevisionUpdate, updated.Action)
+	s.Equal("", updated.Author)
+	s.Equal("renamed", updated.Short)
+	s.Equal(map[string]Change{
+		"short": {From: "ex", To: "renamed"},
+		"descr": {From: "Example item", To: "Renamed"},
+	}, updated.Changes)
+
+	s.Equal(RevisionDelete, history.Revisions[2].Action)
+	s.Empty(history.Revisions[2].Changes)
+	s.Equal(RevisionRestore, history.Revisions[3].Action)
+	s.Equal(4, history.Revisions[3].Rev)
 }
 
-// Send a request with the given method/url/body and return the status code and body
-func (s *S) request(method string, url string, body string) (int, string) {
-	bodyreader := strings.NewReader(body)
-	resp := httptest.NewRecorder()
-	req, err := http.NewRequest(method, url, bodyreader)
+func (s *S) TestHistoryNotExisting() {
+	c, b := s.request("GET", "/shortlinks/something/history", "")
+	s.Equal(404, c)
+	s.Equal(`{"error":"shortlink not found"}`, b)
+}
+
+// Check that revisions whose changes can't be compared respond 500,
+// stored directly as times after the year 9999 can't be encoded as json
+func TestHistoryInvalidRevision(t *testing.T) {
+	store := NewMemoryStore()
+	router, err := setupRoutes(store, DefaultConfig())
 	if err != nil {
-		s.Fail("Failed creating request", err)
+		t.Fatal(err)
+	}
+	shortlink := &Shortlink{ShortUrl: "ex", LongUrl: "http://example.com"}
+	if err := store.Create(shortlink); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)
+	revision := &Revision{ShortlinkID: shortlink.ID, Action: RevisionUpdate,
+		Shortlink: ShortlinkUpdate{ShortUrl: "ex", LongUrl: "http://example.com", ExpiresAt: &expiresAt}}
+	if err := store.AddRevision(revision); err != nil {
+		t.Fatal(err)
 	}
-	s.router.ServeHTTP(resp, req)
 
-	return resp.Code, resp.Body.String()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/shortlinks/ex/history", nil))
+	if w.Code != 500 {
+		t.Fatalf("Expected code 500 for a revision with an invalid time, got %d: %s", w.Code, w.Body.String())
+	}
 }
 
-// Unmarshal a string to a Shortlink
-func unmarshalShortlink(body string) Shortlink {
-	sl := Shortlink{}
-	json.Unmarshal([]byte(body), &sl)
-	return sl
-}
+func (s *S) TestRevert() {
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	renamed := sl
+	renamed.ShortUrl = "renamed"
+	renamed.LongUrl = "http://example.org"
+	c, _ = s.requestSL("PUT", "/shortlinks/ex", renamed)
+	s.Equal(200, c)
 
-// Unmarshal a string to a Shortlink array
-func unmarshalShortlinkArray(body string) []Shortlink {
-	sl := []Shortlink{}
-	json.Unmarshal([]byte(body), &sl)
-	return sl
+	c, b := s.request("POST", "/shortlinks/renamed/revert/1", "")
+	s.Equal(200, c)
+	r := unmarshalShortlink(b)
+	s.Equal(sl.ShortUrl, r.ShortUrl)
+	s.Equal(sl.LongUrl, r.LongUrl)
+	s.Equal(sl.Description, r.Description)
+
+	c, _ = s.request("GET", "/shortlinks/renamed", "")
+	s.Equal(404, c)
+	c, b = s.request("GET", "/shortlinks/ex/history", "")
+	s.Equal(200, c)
+	s.Contains(b, `{"rev":3,"action":"revert",`)
+	s.Contains(b, `"reverted_to":1`)
 }
 
-// Shortlink "ex" pointing to http://example.com
-func exampleShortlink() ShortlinkUpdate {
+func (s *S) TestRevertConflict() {
+	s.createShortlinks("ex", "other")
+	sl := exampleShortlink()
+	sl.ShortUrl = "renamed"
+	c, _ := s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	sl.ShortUrl = "ex"
+	c, _ = s.requestSL("PUT", "/shortlinks/other", sl)
+	s.Equal(200, c)
+
+	c, b := s.request("POST", "/shortlinks/renamed/revert/1", "")
+	s.Equal(409, c)
+	s.Equal(`{"error":"shortlink already exists"}`, b)
+}
+
+func (s *S) TestRevertInvalid() {
+	s.createShortlinks("ex")
+
+	c, b := s.request("POST", "/shortlinks/ex/revert/2", "")
+	s.Equal(404, c)
+	s.Equal(`{"error":"revision not found"}`, b)
+
+	c, b = s.request("POST", "/shortlinks/ex/revert/zero", "")
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid revision"}`, b)
+
+	c, _ = s.request("POST", "/shortlinks/something/revert/1", "")
+	s.Equal(404, c)
+}
+
+/* TESTS FOR CLICK EVENTS */
+
+// Returns the click events of the shortlink once `n` of them have been written
+func (s *S) events(short string, n int) []ClickEvent {
+	var events []ClickEvent
+	s.Eventually(func() bool {
+		c, b := s.request("GET", "/shortlinks/"+short+"/events", "")
+		s.Equal(200, c)
+		// Decode into a new result as omitted fields would keep the values of a previous one
+		var result struct {
+			Events []ClickEvent `json:"events"`
+		}
+		s.NoError(json.Unmarshal([]byte(b), &result))
+		events = result.Events
+		return len(events) >= n
+	}, time.Second, 10*time.Millisecond)
+	return events
+}
+
+func (s *S) TestClickEvents() {
+	defer func(interval time.Duration) { eventFlushInterval = interval }(eventFlushInterval)
+	eventFlushInterval = 10 * time.Millisecond
+
+	sl := exampleShortlink()
+	sl.Aliases = []string{"example"}
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	header := http.Header{
+		"Referer":         []string{"http://example.org/page"},
+		"User-Agent":      []string{"test-agent"},
+		"Accept-Language": []string{"de-DE,de;q=0.9"},
+	}
+	start := now().Add(-time.Millisecond)
+	s.Equal(307, s.sendHeader("GET", "/go/ex", "", header).Code)
+	time.Sleep(10 * time.Millisecond)
+	s.Equal(307, s.send("GET", "/go/example", "").Code)
+	s.Equal(307, s.send("HEAD", "/go/ex", "").Code)
+	s.Equal(404, s.send("GET", "/go/missing", "").Code)
+
+	events := s.events("ex", 2)
+	s.Len(events, 2)
+	s.Equal("example", events[0].Short)
+	s.Equal("", events[0].Referrer)
+
+	clicked := events[1]
+	s.Equal("ex", clicked.Short)
+	s.Equal("http://example.org/page", clicked.Referrer)
+	s.Equal("test-agent", clicked.UserAgent)
+	s.Equal("de-DE,de;q=0.9", clicked.AcceptLanguage)
+	s.True(!clicked.ClickedAt.Before(start) && before(clicked.ClickedAt, now()))
+	s.Len(clicked.ClientHash, 64)
+	s.NotContains(clicked.ClientHash, "192.0.2.1")
+	s.Equal(clicked.ClientHash, events[0].ClientHash)
+
+	// Events are listed by the shortlink, also via its aliases
+	s.Len(s.events("example", 2), 2)
+	c, _ = s.request("GET", "/shortlinks/missing/events", "")
+	s.Equal(404, c)
+	c, _ = s.request("GET", "/shortlinks/ex/events?limit=0", "")
+	s.Equal(400, c)
+}
+
+func (s *S) TestClickEventsDisabled() {
+	config := DefaultConfig()
+	config.RecordEvents = false
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+
+	s.createShortlinks("ex")
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	time.Sleep(50 * time.Millisecond)
+
+	c, b := s.request("GET", "/shortlinks/ex/events", "")
+	s.Equal(200, c)
+	s.Equal(`{"events":[]}`, b)
+}
+
+func (s *S) TestPurgeEvents() {
+	s.createShortlinks("ex")
+	sl, err := s.store.GetShortlinkByShort("ex")
+	s.Require().NoError(err)
+
+	old := now().Add(-time.Hour)
+	s.NoError(s.store.AddEvents([]*ClickEvent{
+		{ShortlinkID: sl.ID, Short: "ex", ClickedAt: old},
+		{ShortlinkID: sl.ID, Short: "ex", ClickedAt: now().Add(-time.Second)},
+	}))
+
+	purged, err := s.store.PurgeEvents(old.Add(time.Minute))
+	s.NoError(err)
+	s.Equal(int64(1), purged)
+	events, err := s.store.ListEvents(sl.ID, 10)
+	s.NoError(err)
+	s.Len(events, 1)
+}
+
+/* TESTS FOR CLICK STATISTICS */
+
+func (s *S) TestClickStats() {
+	s.createShortlinks("ex")
+	sl, err := s.store.GetShortlinkByShort("ex")
+	s.Require().NoError(err)
+
+	day := time.Date(2021, 9, 15, 0, 0, 0, 0, time.UTC)
+	click := func(at time.Time, client int, referrer string, agent string) *ClickEvent {
+		return &ClickEvent{ShortlinkID: sl.ID, Short: "ex", ClickedAt: at,
+			ClientHash: clientHash(client), Referrer: referrer, UserAgent: agent}
+	}
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:92.0) Gecko/20100101 Firefox/92.0"
+	chrome := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/94.0.4606.61 Safari/537.36"
+	s.NoError(s.store.AddEvents([]*ClickEvent{
+		click(day.Add(9*time.Hour), 1, "https://www.example.org/a", firefox),
+		click(day.Add(9*time.Hour+time.Minute), 1, "https://www.example.org/b", firefox),
+		click(day.Add(10*time.Hour), 2, "https://news.example.net/", chrome),
+	}))
+	// Rolled up into the existing hour
+	s.NoError(s.store.AddEvents([]*ClickEvent{
+		click(day.Add(9*time.Hour+2*time.Minute), 3, "", "curl/7.68.0"),
+		click(day.Add(26*time.Hour), 2, "https://www.example.org/", chrome),
+		// Outside of the range
+		click(day.Add(-time.Hour), 4, "", chrome),
+	}))
+
+	c, b := s.request("GET", "/shortlinks/ex/stats?bucket=day&from=2021-09-15T12:00:00Z&to=2021-09-17T00:00:00Z", "")
+	s.Equal(200, c, b)
+	var stats ClickStats
+	s.NoError(json.Unmarshal([]byte(b), &stats))
+	s.Equal("ex", stats.Short)
+	s.Equal(day, stats.From)
+	s.Equal(int64(5), stats.Clicks)
+	s.Equal(int64(3), stats.UniqueVisitors)
+	s.Len(stats.Series, 2)
+	s.Equal(ClickBucket{Start: day, Clicks: 4, UniqueVisitors: 3}, *stats.Series[0])
+	s.Equal(ClickBucket{Start: day.AddDate(0, 0, 1), Clicks: 1, UniqueVisitors: 1}, *stats.Series[1])
+	s.Equal([]*ClickCount{{Name: "www.example.org", Clicks: 3}, {Name: "news.example.net", Clicks: 1}}, stats.TopReferrers)
+	s.Equal([]*ClickCount{{Name: "Chrome", Clicks: 2}, {Name: "Firefox", Clicks: 2}, {Name: "curl", Clicks: 1}}, stats.TopUserAgents)
+
+	c, b = s.request("GET", "/shortlinks/ex/stats?bucket=hour&from=2021-09-15T09:30:00Z&to=2021-09-15T11:00:00Z", "")
+	s.Equal(200, c, b)
+	s.NoError(json.Unmarshal([]byte(b), &stats))
+	s.Len(stats.Series, 2)
+	s.Equal(int64(3), stats.Series[0].Clicks)
+	s.Equal(int64(1), stats.Series[1].Clicks)
+
+	// Purging click events keeps their statistics
+	_, err = s.store.PurgeEvents(day.AddDate(0, 0, 2))
+	s.NoError(err)
+	c, b = s.request("GET", "/shortlinks/ex/stats?bucket=week&from=2021-09-15T00:00:00Z&to=2021-09-17T00:00:00Z", "")
+	s.Equal(200, c, b)
+	s.NoError(json.Unmarshal([]byte(b), &stats))
+	s.Equal(day.AddDate(0, 0, -2), stats.From)
+	s.Equal(int64(6), stats.Clicks)
+	s.Equal(int64(4), stats.UniqueVisitors)
+}
+
+func (s *S) TestClickStatsInvalid() {
+	s.createShortlinks("ex")
+
+	c, b := s.request("GET", "/shortlinks/ex/stats?bucket=month", "")
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid bucket, must be one of hour, day, week"}`, b)
+	c, _ = s.request("GET", "/shortlinks/ex/stats?from=yesterday", "")
+	s.Equal(400, c)
+	c, _ = s.request("GET", "/shortlinks/ex/stats?from=2021-09-16T00:00:00Z&to=2021-09-15T00:00:00Z", "")
+	s.Equal(400, c)
+	c, b = s.request("GET", "/shortlinks/ex/stats?bucket=week&from=2020-01-01T00:00:00Z&to=2021-01-01T00:00:00Z", "")
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid range, must not span more than 8784 hours"}`, b)
+	c, b = s.request("GET", "/shortlinks/ex/stats?bucket=hour&from=2020-01-01T00:00:00Z&to=2020-12-31T00:00:00Z", "")
+	s.Equal(200, c, b)
+	c, _ = s.request("GET", "/shortlinks/missing/stats", "")
+	s.Equal(404, c)
+
+	c, b = s.request("GET", "/shortlinks/ex/stats", "")
+	s.Equal(200, c)
+	var stats ClickStats
+	s.NoError(json.Unmarshal([]byte(b), &stats))
+	s.Equal(BucketDay, stats.Bucket)
+	s.Len(stats.Series, 31)
+	s.Equal(int64(0), stats.Clicks)
+}
+
+func TestVisitorSketch(t *testing.T) {
+	sketch := newVisitorSketch()
+	other := newVisitorSketch()
+	for i := 0; i < 100000; i++ {
+		sketch.add(clientHash(i))
+		if i%2 == 0 {
+			other.add(clientHash(i + 100000))
+		}
+	}
+	// The standard error is about 3%
+	if estimate := sketch.estimate(); estimate < 90000 || estimate > 110000 {
+		t.Fatalf("Expected about 100000 visitors, estimated %d", estimate)
+	}
+	if estimate := sketch.merge(other).estimate(); estimate < 135000 || estimate > 165000 {
+		t.Fatalf("Expected about 150000 visitors after merging, estimated %d", estimate)
+	}
+	if estimate := newVisitorSketch().estimate(); estimate != 0 {
+		t.Fatalf("Expected no visitors, estimated %d", estimate)
+	}
+}
+
+/* TESTS FOR GET ALL */
+
+func (s *S) TestGetAllEmpty() {
+	c, b := s.request("GET", "/shortlinks", "")
+
+	s.Equal(200, c)
+	s.Equal(`{"shortlinks":[],"total":0}`, b)
+}
+
+func (s *S) TestGetAllOne() {
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", "/shortlinks", "")
+	r := unmarshalShortlinkPage(b).Shortlinks
+
+	s.Equal(200, c)
+
+	s.Equal(sl.Description, r[0].Description, b)
+	s.Equal(sl.ShortUrl, r[0].ShortUrl, b)
+	s.Equal(sl.LongUrl, r[0].LongUrl, b)
+	s.Contains(b, `"redirect":"http://shorty.test/go/ex"`)
+}
+
+func (s *S) TestGetAllPaginated() {
+	s.createShortlinks("a", "b", "c", "d", "e")
+
+	shorts := []string{}
+	url := "/shortlinks?limit=2"
+	for i := 0; i < 3; i++ {
+		c, b := s.request("GET", url, "")
+		s.Equal(200, c, b)
+		page := unmarshalShortlinkPage(b)
+		s.Equal(int64(5), page.Total)
+		for _, sl := range page.Shortlinks {
+			shorts = append(shorts, sl.ShortUrl)
+		}
+		url = "/shortlinks?limit=2&page_token=" + page.NextPageToken
+		if i == 2 {
+			s.Empty(page.NextPageToken)
+		}
+	}
+	s.Equal([]string{"a", "b", "c", "d", "e"}, shorts)
+}
+
+func (s *S) TestGetAllSorted() {
+	s.createShortlinks("b", "c", "a")
+
+	c, b := s.request("GET", "/shortlinks?sort=short", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"a", "b", "c"}, shortsOf(unmarshalShortlinkPage(b)))
+
+	c, b = s.request("GET", "/shortlinks?sort=-short", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"c", "b", "a"}, shortsOf(unmarshalShortlinkPage(b)))
+
+	s.request("GET", "/go/c", "")
+	s.request("GET", "/go/c", "")
+	s.request("GET", "/go/a", "")
+	s.server.counter.Flush()
+	c, b = s.request("GET", "/shortlinks?sort=-access_count", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"c", "a", "b"}, shortsOf(unmarshalShortlinkPage(b)))
+}
+
+func (s *S) TestGetAllFiltered() {
+	s.createShortlinks("docs", "docs-api", "wiki")
+	sl := exampleShortlink()
+	sl.ShortUrl = "other"
+	sl.LongUrl = "https://WWW.Example.org:8443/path"
+	s.requestSL("POST", "/shortlinks", sl)
+
+	c, b := s.request("GET", "/shortlinks?prefix=docs", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"docs", "docs-api"}, shortsOf(unmarshalShortlinkPage(b)))
+
+	c, b = s.request("GET", "/shortlinks?host=www.example.org", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"other"}, shortsOf(unmarshalShortlinkPage(b)))
+
+	c, b = s.request("GET", "/shortlinks?created_after=2000-01-01T00:00:00Z&created_before=2100-01-01T00:00:00Z", "")
+	s.Equal(200, c, b)
+	s.Equal(int64(4), unmarshalShortlinkPage(b).Total)
+
+	c, b = s.request("GET", "/shortlinks?created_after="+now().Add(time.Hour).Format(time.RFC3339), "")
+	s.Equal(200, c, b)
+	s.Equal(int64(0), unmarshalShortlinkPage(b).Total)
+}
+
+func (s *S) TestGetAllInvalidQuery() {
+	for _, query := range []string{"limit=0", "limit=abc", "page_token=x", "sort=long", "created_after=yesterday"} {
+		c, _ := s.request("GET", "/shortlinks?"+query, "")
+		s.Equal(400, c, query)
+	}
+}
+
+/* TESTS FOR SEARCH */
+
+func (s *S) TestSearchRanking() {
+	s.createShortlinks("wiki", "wiki-admin", "docs", "help", "other")
+	for short, descr := range map[string]string{"docs": "Team wiki and documentation", "help": "Ask on the wiki"} {
+		sl := exampleShortlink()
+		sl.ShortUrl = short
+		sl.Description = descr
+		c, b := s.requestSL("PUT", "/shortlinks/"+short, sl)
+		s.Equal(200, c, b)
+	}
+	sl := exampleShortlink()
+	sl.ShortUrl = "other"
+	sl.LongUrl = "https://wiki.example.com/other"
+	c, b := s.requestSL("PUT", "/shortlinks/other", sl)
+	s.Equal(200, c, b)
+
+	c, b = s.request("GET", "/shortlinks/search?q=Wiki", "")
+	s.Equal(200, c, b)
+	// Exact match, prefix match, matches of the description and of the target URL
+	s.Equal([]string{"wiki", "wiki-admin", "docs", "help", "other"}, shortsOf(unmarshalShortlinkPage(b)))
+
+	c, b = s.request("GET", "/shortlinks/search?q=wiki&limit=2", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"wiki", "wiki-admin"}, shortsOf(unmarshalShortlinkPage(b)))
+}
+
+func (s *S) TestSearchTerms() {
+	s.createShortlinks("a", "b")
+	sl := exampleShortlink()
+	sl.ShortUrl = "b"
+	sl.Description = "Quarterly planning board"
+	s.requestSL("PUT", "/shortlinks/b", sl)
+
+	c, b := s.request("GET", "/shortlinks/search?q=plan+roadmap", "")
+	s.Equal(200, c, b)
+	s.Equal([]string{"b"}, shortsOf(unmarshalShortlinkPage(b)))
+
+	c, b = s.request("GET", "/shortlinks/search?q=nothing", "")
+	s.Equal(200, c, b)
+	s.Equal(`{"shortlinks":[],"total":0}`, b)
+}
+
+func (s *S) TestSearchInvalid() {
+	c, _ := s.request("GET", "/shortlinks/search", "")
+	s.Equal(400, c)
+	c, _ = s.request("GET", "/shortlinks/search?q=x&limit=1000", "")
+	s.Equal(400, c)
+}
+
+func (s *S) TestSearchDoesNotShadowShorts() {
+	s.createShortlinks("searching")
+	c, b := s.request("GET", "/shortlinks/searching", "")
+	s.Equal(200, c)
+	s.Equal("searching", unmarshalShortlink(b).ShortUrl)
+}
+
+/* TESTS FOR CHECK */
+
+func (s *S) TestCheckNotExisting() {
+	c, b := s.request("GET", "/check/something", "")
+
+	s.Equal(200, c)
+	s.Equal(`{"free":true}`, b)
+}
+func (s *S) TestCheckExistent() {
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", fmt.Sprintf("/check/%s", sl.ShortUrl), "")
+
+	s.Equal(200, c)
+	s.Equal(`{"free":false}`, b)
+}
+
+func (s *S) TestCheckInvalid() {
+	c, b := s.request("GET", "/check/käse", "")
+
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid short does not match ^[a-zA-Z0-9\\-_]+$"}`, b)
+}
+
+/* TEST FOR REDIRECT */
+
+func (s *S) TestRedirectNotExisting() {
+	c, b := s.request("GET", "/go/somewhere", "")
+
+	s.Equal(404, c)
+	s.Equal(`{"error":"no redirect for somewhere"}`, b)
+}
+
+func (s *S) TestRedirectNotExistingSuggestions() {
+	s.createShortlinks("docs", "docker", "calendar", "mail")
+
+	c, b := s.request("GET", "/go/doc", "")
+	s.Equal(404, c)
+	s.JSONEq(`{"error":"no redirect for doc","suggestions":["docs","docker"]}`, b)
+
+	c, b = s.request("GET", "/go/calender", "")
+	s.Equal(404, c)
+	s.JSONEq(`{"error":"no redirect for calender","suggestions":["calendar"]}`, b)
+}
+
+// Check that suggestions are cached until shortlinks are changed via the API
+func (s *S) TestRedirectNotExistingSuggestionsCached() {
+	s.createShortlinks("docs")
+	c, b := s.request("GET", "/go/doc", "")
+	s.Equal(404, c)
+	s.JSONEq(`{"error":"no redirect for doc","suggestions":["docs"]}`, b)
+
+	// Changes bypassing the API aren't seen until the shorts expire
+	s.NoError(s.store.Create(&Shortlink{ShortUrl: "docker", LongUrl: "http://example.com"}))
+	c, b = s.request("GET", "/go/doc", "")
+	s.Equal(404, c)
+	s.JSONEq(`{"error":"no redirect for doc","suggestions":["docs"]}`, b)
+
+	s.Equal(200, s.send("DELETE", "/shortlinks/docs", "").Code)
+	c, b = s.request("GET", "/go/doc", "")
+	s.Equal(404, c)
+	s.JSONEq(`{"error":"no redirect for doc","suggestions":["docker"]}`, b)
+}
+
+func (s *S) TestRedirectNotExistingPage() {
+	s.createShortlinks("docs", "mail")
+
+	resp := s.sendHeader("GET", "/go/doc", "", http.Header{"Accept": {"text/html,application/xhtml+xml,*/*;q=0.8"}})
+	s.Equal(404, resp.Code)
+	s.Contains(resp.Header().Get("Content-Type"), "text/html")
+	b := resp.Body.String()
+	s.Contains(b, `<a href="/go/docs">go/docs</a>`)
+	s.NotContains(b, "go/mail")
+	s.Contains(b, `<a href="/new?short=doc">Create go/doc</a>`)
+}
+
+func (s *S) TestNewPage() {
+	resp := s.sendHeader("GET", "/new?short=doc%22s", "", http.Header{"Accept": {"text/html"}})
+	s.Equal(200, resp.Code)
+	s.Contains(resp.Header().Get("Content-Type"), "text/html")
+	s.Contains(resp.Body.String(), `value="doc&#34;s"`)
+}
+
+func (s *S) TestRedirectExisting() {
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", fmt.Sprintf("/go/%s", sl.ShortUrl), "")
+
+	s.Equal(307, c)
+	s.Equal(fmt.Sprintf("<a href=\"%s\">Temporary Redirect</a>.\n\n", sl.LongUrl), b)
+}
+
+func (s *S) TestRedirectForward() {
+	cases := []struct {
+		long     string
+		path     string
+		location string
+	}{
+		{"http://example.com", "/go/fw", "http://example.com"},
+		{"http://example.com", "/go/fw/", "http://example.com/"},
+		{"http://example.com", "/go/fw/docs/start", "http://example.com/docs/start"},
+		{"http://example.com/docs/", "/go/fw/start", "http://example.com/docs/start"},
+		{"http://example.com/docs", "/go/fw//start", "http://example.com/docs/start"},
+		{"http://example.com/a%2Fb", "/go/fw/c%2Fd", "http://example.com/a%2Fb/c%2Fd"},
+		{"http://example.com/docs?lang=en", "/go/fw/start", "http://example.com/docs/start?lang=en"},
+		{"http://example.com/docs?lang=en&v=1", "/go/fw?lang=de&q=x+y", "http://example.com/docs?lang=de&q=x+y&v=1"},
+		{"http://example.com/docs#top", "/go/fw/start?q=1", "http://example.com/docs/start?q=1#top"},
+	}
+	for _, tc := range cases {
+		sl := ShortlinkUpdate{ShortUrl: "fw", LongUrl: tc.long, Forward: true}
+		c, _ := s.requestSL("POST", "/shortlinks", sl)
+		s.Equal(201, c)
+
+		resp := s.send("GET", tc.path, "")
+		s.Equal(307, resp.Code, tc.path)
+		s.Equal(tc.location, resp.Header().Get("Location"), "%s to %s", tc.path, tc.long)
+
+		s.request("DELETE", "/shortlinks/fw", "")
+	}
+}
+
+func (s *S) TestRedirectForwardDisabled() {
+	sl := exampleShortlink()
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.False(unmarshalShortlink(b).Forward)
+
+	// Paths aren't accepted, trailing slashes and queries are ignored
+	c, b = s.request("GET", "/go/ex/docs?q=1", "")
+	s.Equal(404, c)
+	s.Equal(`{"error":"no redirect for ex/docs"}`, b)
+	for _, path := range []string{"/go/ex/", "/go/ex?q=1"} {
+		resp := s.send("GET", path, "")
+		s.Equal(307, resp.Code, path)
+		s.Equal("http://example.com", resp.Header().Get("Location"), path)
+	}
+
+	sl.Forward = true
+	c, b = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.True(unmarshalShortlink(b).Forward)
+
+	resp := s.send("GET", "/go/ex/docs?q=1", "")
+	s.Equal(307, resp.Code)
+	s.Equal("http://example.com/docs?q=1", resp.Header().Get("Location"))
+}
+
+func (s *S) TestRedirectTemplate() {
+	cases := []struct {
+		long     string
+		forward  bool
+		path     string
+		location string
+	}{
+		{"https://jira.example.com/browse/{1}", false, "/go/tpl/ABC-1", "https://jira.example.com/browse/ABC-1"},
+		{"https://jira.example.com/browse/{ticket}", false, "/go/tpl/ABC-1/", "https://jira.example.com/browse/ABC-1"},
+		{"https://example.com/{2}/{1}", false, "/go/tpl/a/b", "https://example.com/b/a"},
+		{"https://example.com/{project}/issues/{id}", false, "/go/tpl/shorty/42", "https://example.com/shorty/issues/42"},
+		{"https://example.com/search?q={1}", false, "/go/tpl/a%20b&c", "https://example.com/search?q=a+b%26c"},
+		{"https://example.com/{1}?q={1}", false, "/go/tpl/a%2Fb", "https://example.com/a%2Fb?q=a%2Fb"},
+		{"https://example.com/{1}", false, "/go/tpl/a?c=d", "https://example.com/a"},
+		{"https://example.com/{1}", true, "/go/tpl/a/b?c=d", "https://example.com/a/b?c=d"},
+	}
+	for _, tc := range cases {
+		sl := ShortlinkUpdate{ShortUrl: "tpl", LongUrl: tc.long, Forward: tc.forward}
+		c, _ := s.requestSL("POST", "/shortlinks", sl)
+		s.Equal(201, c, tc.long)
+
+		resp := s.send("GET", tc.path, "")
+		s.Equal(307, resp.Code, tc.path)
+		s.Equal(tc.location, resp.Header().Get("Location"), "%s to %s", tc.path, tc.long)
+
+		s.request("DELETE", "/shortlinks/tpl", "")
+	}
+}
+
+func (s *S) TestRedirectTemplateMissingArguments() {
+	sl := ShortlinkUpdate{ShortUrl: "jira", LongUrl: "https://jira.example.com/{project}/{2}"}
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", "/go/jira/shorty", "")
+	s.Equal(400, c)
+	s.JSONEq(`{"error":"missing arguments for go/jira","usage":"go/jira/{project}/{2}"}`, b)
+
+	c, _ = s.request("GET", "/go/jira/shorty/42", "")
+	s.Equal(307, c)
+
+	// Segments following the arguments are only accepted if the shortlink forwards them
+	c, b = s.request("GET", "/go/jira/shorty/42/extra", "")
+	s.Equal(404, c)
+	s.Equal(`{"error":"no redirect for jira/shorty/42/extra"}`, b)
+}
+
+func (s *S) TestCreateInvalidTemplate() {
+	sl := ShortlinkUpdate{ShortUrl: "tpl", LongUrl: "{host}/browse/{1}"}
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid redirect url"}`, b)
+
+	sl.LongUrl = "https://{host}/browse/{1}"
+	c, _ = s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+}
+
+func (s *S) TestRedirectType() {
+	sl := exampleShortlink()
+	sl.RedirectType = 301
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.Equal(301, unmarshalShortlink(b).RedirectType)
+
+	resp := s.send("GET", "/go/ex", "")
+	s.Equal(301, resp.Code)
+	s.Equal(sl.LongUrl, resp.Header().Get("Location"))
+
+	sl.RedirectType = 302
+	c, _ = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Equal(302, s.send("GET", "/go/ex/", "").Code)
+
+	sl.RedirectType = 0
+	c, _ = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+}
+
+func (s *S) TestRedirectTypeDefault() {
+	config := DefaultConfig()
+	config.RedirectType = 308
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.Equal(308, s.send("GET", "/go/ex", "").Code)
+
+	config.RedirectType = 200
+	_, err = setupRoutes(s.store, config)
+	s.Error(err)
+}
+
+func (s *S) TestRedirectTypeInvalid() {
+	sl := exampleShortlink()
+	sl.RedirectType = 200
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid redirect type, must be one of [301 302 303 307 308]"}`, b)
+
+	sl.RedirectType = 0
+	c, _ = s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	sl.RedirectType = 304
+	c, _ = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(400, c)
+}
+
+func (s *S) TestRedirectHead() {
+	sl := exampleShortlink()
+	sl.RedirectType = 308
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	resp := s.send("HEAD", "/go/ex", "")
+	s.Equal(308, resp.Code)
+	s.Equal(sl.LongUrl, resp.Header().Get("Location"))
+	s.Equal(404, s.send("HEAD", "/go/missing", "").Code)
+
+	c, b := s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Equal(0, unmarshalShortlink(b).AccessCount)
+}
+
+func (s *S) TestRedirectExpired() {
+	sl := exampleShortlink()
+	expiresAt := now().Add(-time.Minute)
+	sl.ExpiresAt = &expiresAt
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.True(expiresAt.Equal(*unmarshalShortlink(b).ExpiresAt))
+
+	c, b = s.request("GET", "/go/ex", "")
+	s.Equal(410, c)
+	s.Equal(`{"error":"shortlink ex expired"}`, b)
+	s.Equal(410, s.send("HEAD", "/go/ex", "").Code)
+
+	expiresAt = now().Add(time.Hour)
+	c, _ = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+
+	sl.ExpiresAt = nil
+	c, b = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.NotContains(b, "expires_at")
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+
+	c, b = s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Equal(2, unmarshalShortlink(b).AccessCount)
+}
+
+func (s *S) TestRedirectMaxClicks() {
+	sl := exampleShortlink()
+	sl.MaxClicks = 2
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	s.Equal(307, s.send("HEAD", "/go/ex", "").Code)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	s.Equal(410, s.send("GET", "/go/ex", "").Code)
+	s.Equal(410, s.send("HEAD", "/go/ex", "").Code)
+
+	c, b := s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Equal(2, unmarshalShortlink(b).AccessCount)
+}
+
+// Check that max_clicks is not exceeded by concurrent redirects
+func (s *S) TestRedirectMaxClicksConcurrent() {
+	sl := exampleShortlink()
+	sl.MaxClicks = 10
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	codes := make(chan int)
+	for i := 0; i < 50; i++ {
+		go func() {
+			codes <- s.send("GET", "/go/ex", "").Code
+		}()
+	}
+	redirects := 0
+	for i := 0; i < 50; i++ {
+		if <-codes == 307 {
+			redirects++
+		}
+	}
+	s.Equal(10, redirects)
+}
+
+func (s *S) TestRedirectExpiredURL() {
+	config := DefaultConfig()
+	config.ExpiredURL = "https://example.com/expired"
+	config.RedirectType = 302
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+
+	sl := exampleShortlink()
+	expiresAt := now().Add(-time.Second)
+	sl.ExpiresAt = &expiresAt
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	// Redirected with the configured redirect type
+	resp := s.send("GET", "/go/ex", "")
+	s.Equal(302, resp.Code)
+	s.Equal(config.ExpiredURL, resp.Header().Get("Location"))
+
+	config.ExpiredURL = "expired"
+	_, err = setupRoutes(s.store, config)
+	s.Error(err)
+}
+
+func (s *S) TestRedirectScheduled() {
+	sl := exampleShortlink()
+	activeFrom := now().Add(time.Hour)
+	sl.ActiveFrom = &activeFrom
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.Contains(b, `"state":"scheduled"`)
+
+	c, b = s.request("GET", "/go/ex", "")
+	s.Equal(404, c)
+	s.JSONEq(fmt.Sprintf(`{"error":"shortlink ex is not active yet","active_from":"%s"}`,
+		activeFrom.Format(time.RFC3339Nano)), b)
+	s.Equal(404, s.send("HEAD", "/go/ex", "").Code)
+
+	resp := s.sendHeader("GET", "/go/ex", "", http.Header{"Accept": {"text/html"}})
+	s.Equal(404, resp.Code)
+	s.Contains(resp.Body.String(), "go/ex is coming soon")
+	s.Contains(resp.Body.String(), activeFrom.Format(time.RFC1123))
+
+	c, b = s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Contains(b, `"state":"scheduled"`)
+	s.Equal(0, unmarshalShortlink(b).AccessCount)
+
+	activeFrom = now().Add(-time.Second)
+	c, b = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Contains(b, `"state":"active"`)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+}
+
+func (s *S) TestShortlinkState() {
+	sl := exampleShortlink()
+	sl.MaxClicks = 1
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.Contains(b, `"state":"active"`)
+
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	c, b = s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Contains(b, `"state":"expired"`)
+}
+
+// Check that the access count and deletion time of created shortlinks can't be set by clients
+func (s *S) TestCreateServerOwnedFields() {
+	c, b := s.request("POST", "/shortlinks",
+		`{"short":"ex","long":"http://example.com","access_count":5,"deleted_at":"2021-09-15T00:00:00Z"}`)
+	s.Equal(201, c, b)
+	s.Contains(b, `"state":"active"`)
+	s.NotContains(b, "deleted_at")
+	s.Equal(0, unmarshalShortlink(b).AccessCount)
+
+	c, b = s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Contains(b, `"state":"active"`)
+	s.NotContains(b, "deleted_at")
+	s.Equal(0, unmarshalShortlink(b).AccessCount)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+}
+
+// Check that deleted shortlinks don't redirect
+func TestRedirectErrorDeleted(t *testing.T) {
+	deletedAt := now()
+	link := &Shortlink{ShortUrl: "ex", DeletedAt: &deletedAt}
+	if err := link.redirectError(now()); !isNotFundError(err) {
+		t.Fatalf("Expected ErrNotFound for a deleted shortlink, got %v", err)
+	}
+}
+
+func (s *S) TestRedirectDisabled() {
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+
+	sl.Disabled = true
+	c, b := s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Contains(b, `"state":"disabled"`)
+
+	c, b = s.request("GET", "/go/ex", "")
+	s.Equal(410, c)
+	s.Equal(`{"error":"shortlink disabled"}`, b)
+	s.Equal(410, s.send("HEAD", "/go/ex", "").Code)
+
+	sl.Disabled = false
+	c, _ = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+
+	c, b = s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Equal(2, unmarshalShortlink(b).AccessCount)
+}
+
+func (s *S) TestRedirectDisabledConfig() {
+	config := DefaultConfig()
+	config.DisabledStatus = 451
+	config.DisabledMessage = "removed on request"
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+
+	sl := exampleShortlink()
+	sl.Disabled = true
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", "/go/ex", "")
+	s.Equal(451, c)
+	s.Equal(`{"error":"removed on request"}`, b)
+
+	config.DisabledStatus = 404
+	_, err = setupRoutes(s.store, config)
+	s.Error(err)
+}
+
+func (s *S) TestGetAllByState() {
+	past := now().Add(-time.Hour)
+	future := now().Add(time.Hour)
+	for _, sl := range []ShortlinkUpdate{
+		{ShortUrl: "active", LongUrl: "http://example.com", ActiveFrom: &past, ExpiresAt: &future},
+		{ShortUrl: "scheduled", LongUrl: "http://example.com", ActiveFrom: &future},
+		{ShortUrl: "expired", LongUrl: "http://example.com", ExpiresAt: &past},
+		{ShortUrl: "exhausted", LongUrl: "http://example.com", MaxClicks: 1},
+		{ShortUrl: "disabled", LongUrl: "http://example.com", Disabled: true, ExpiresAt: &past},
+		{ShortUrl: "plain", LongUrl: "http://example.com"},
+	} {
+		c, _ := s.requestSL("POST", "/shortlinks", sl)
+		s.Equal(201, c)
+	}
+	s.Equal(307, s.send("GET", "/go/exhausted", "").Code)
+
+	for state, expected := range map[string][]string{
+		"active":    {"active", "plain"},
+		"scheduled": {"scheduled"},
+		"expired":   {"exhausted", "expired"},
+		"disabled":  {"disabled"},
+	} {
+		c, b := s.request("GET", "/shortlinks?sort=short&state="+state, "")
+		s.Equal(200, c)
+		page := unmarshalShortlinkPage(b)
+		s.Equal(expected, shortsOf(page), state)
+		s.Equal(int64(len(expected)), page.Total, state)
+	}
+
+	c, b := s.request("GET", "/shortlinks?state=deleted", "")
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid state, must be one of active, scheduled, expired, disabled"}`, b)
+}
+
+func (s *S) TestCreateInvalidMaxClicks() {
+	sl := exampleShortlink()
+	sl.MaxClicks = -1
+	c, b := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid max_clicks, must not be negative"}`, b)
+}
+
+func (s *S) TestPurgeExpired() {
+	expiresAt := now().Add(-time.Second)
+	for _, sl := range []ShortlinkUpdate{
+		{ShortUrl: "expired", LongUrl: "http://example.com", ExpiresAt: &expiresAt},
+		{ShortUrl: "exhausted", LongUrl: "http://example.com", MaxClicks: 1},
+		{ShortUrl: "live", LongUrl: "http://example.com", MaxClicks: 2},
+	} {
+		c, _ := s.requestSL("POST", "/shortlinks", sl)
+		s.Equal(201, c)
+	}
+	s.Equal(307, s.send("GET", "/go/exhausted", "").Code)
+	s.Equal(307, s.send("GET", "/go/live", "").Code)
+
+	deleted, err := s.store.PurgeExpired()
+	s.NoError(err)
+	s.Equal(int64(2), deleted)
+
+	c, b := s.request("GET", "/shortlinks", "")
+	s.Equal(200, c)
+	s.Equal([]string{"live"}, shortsOf(unmarshalShortlinkPage(b)))
+}
+
+func (s *S) TestRedirectInvalid() {
+	c, b := s.request("GET", "/go/käse", "")
+
+	s.Equal(400, c)
+	s.Equal(`{"error":"invalid short does not match ^[a-zA-Z0-9\\-_]+$"}`, b)
+}
+
+/* ********************************************** *
+ * *************** BEHAVIOR TESTS *************** *
+ * ********************************************** */
+
+// Check that redirects increment the access_count and that it is preserved by update
+func (s *S) TestRedirectCount() {
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, c)
+	r := unmarshalShortlink(b)
+	s.Equal(0, r.AccessCount)
+
+	c, b = s.request("GET", fmt.Sprintf("/go/%s", sl.ShortUrl), "")
+	s.Equal(307, c)
+	s.Equal(fmt.Sprintf("<a href=\"%s\">Temporary Redirect</a>.\n\n", sl.LongUrl), b)
+
+	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, c)
+	r = unmarshalShortlink(b)
+	s.Equal(1, r.AccessCount)
+
+	s.request("GET", fmt.Sprintf("/go/%s", sl.ShortUrl), "")
+	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, c)
+	r = unmarshalShortlink(b)
+	s.Equal(2, r.AccessCount)
+
+	oldshort := sl.ShortUrl
+	sl.ShortUrl = "newurl"
+	c, b = s.requestSL("PUT", fmt.Sprintf("/shortlinks/%s", oldshort), sl)
+	s.Equal(200, c)
+	r = unmarshalShortlink(b)
+
+	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, c)
+	r = unmarshalShortlink(b)
+	s.Equal(2, r.AccessCount)
+}
+
+// Check that redirects are counted in memory and written to the store in bulk
+func (s *S) TestRedirectCountBatched() {
+	s.createShortlinks("ex", "other")
+	for _, short := range []string{"ex", "ex", "other"} {
+		s.Equal(307, s.send("GET", "/go/"+short, "").Code)
+	}
+	s.Equal(307, s.send("HEAD", "/go/ex", "").Code)
+
+	stored, err := s.store.GetShortlinkByShort("ex")
+	s.NoError(err)
+	s.Equal(0, stored.AccessCount)
+	c, b := s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Equal(2, unmarshalShortlink(b).AccessCount)
+
+	s.server.counter.Flush()
+	stored, err = s.store.GetShortlinkByShort("ex")
+	s.NoError(err)
+	s.Equal(2, stored.AccessCount)
+	stored, err = s.store.GetShortlinkByShort("other")
+	s.NoError(err)
+	s.Equal(1, stored.AccessCount)
+	c, b = s.request("GET", "/shortlinks/ex", "")
+	s.Equal(200, c)
+	s.Equal(2, unmarshalShortlink(b).AccessCount)
+
+	// Counts of shortlinks deleted before they are written are dropped
+	s.Equal(307, s.send("GET", "/go/other", "").Code)
+	s.Equal(200, s.send("DELETE", "/shortlinks/other", "").Code)
+	s.server.counter.Flush()
+	c, b = s.request("GET", "/trash", "")
+	s.Equal(200, c)
+	s.Equal(1, unmarshalShortlinkPage(b).Shortlinks[0].AccessCount)
+}
+
+// Check that redirects are counted synchronously by the store if configured
+func (s *S) TestRedirectCountSynchronous() {
+	config := DefaultConfig()
+	config.AccessCountInterval = 0
+	config.RedirectCacheSize = 0
+	router, err := setupRoutes(s.store, config)
+	s.Require().NoError(err)
+	s.router = router
+
+	s.createShortlinks("ex")
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	s.Equal(307, s.send("HEAD", "/go/ex", "").Code)
+	stored, err := s.store.GetShortlinkByShort("ex")
+	s.NoError(err)
+	s.Equal(1, stored.AccessCount)
+}
+
+// Check that redirects are served from the cache and changes via the API invalidate it
+func (s *S) TestRedirectCache() {
+	location := func(short string) string {
+		resp := s.send("GET", "/go/"+short, "")
+		if resp.Code != 307 {
+			return strconv.Itoa(resp.Code)
+		}
+		return resp.Header().Get("Location")
+	}
+
+	// Changes bypassing the API aren't seen until the entry expires
+	s.createShortlinks("cached", "ex")
+	s.Equal("http://example.com", location("cached"))
+	_, err := s.store.Delete("cached")
+	s.NoError(err)
+	s.Equal("http://example.com", location("cached"))
+	s.Equal("404", location("new"))
+	s.NoError(s.store.Create(&Shortlink{ShortUrl: "new", LongUrl: "http://example.com/new", Shorts: []string{"new"}, Keys: []string{"new"}}))
+	s.Equal("404", location("new"))
+
+	// Updates, renames and removed aliases
+	s.Equal("http://example.com", location("ex"))
+	sl := exampleShortlink()
+	sl.LongUrl = "http://example.com/updated"
+	sl.Aliases = []string{"alias"}
+	c, b := s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c, b)
+	s.Equal("http://example.com/updated", location("ex"))
+	s.Equal("http://example.com/updated", location("alias"))
+	s.Equal("404", location("renamed"))
+	sl.ShortUrl = "renamed"
+	sl.Aliases = nil
+	c, b = s.requestSL("PUT", "/shortlinks/ex", sl)
+	s.Equal(200, c, b)
+	s.Equal("404", location("ex"))
+	s.Equal("404", location("alias"))
+	s.Equal("http://example.com/updated", location("renamed"))
+
+	// Deletes and restores
+	s.Equal(200, s.send("DELETE", "/shortlinks/renamed", "").Code)
+	s.Equal("404", location("renamed"))
+	s.Equal(200, s.send("POST", "/trash/renamed/restore", "").Code)
+	s.Equal("http://example.com/updated", location("renamed"))
+
+	// Creates of shorts cached as misses
+	s.Equal("404", location("created"))
+	s.createShortlinks("created")
+	s.Equal("http://example.com", location("created"))
+}
+
+// Check that the redirect cache is rejected if redirects are counted by the store
+func (s *S) TestRedirectCacheRequiresCounter() {
+	config := DefaultConfig()
+	config.AccessCountInterval = 0
+	_, err := newServer(s.store, config)
+	s.Error(err)
+	config.RedirectCacheSize = 0
+	server, err := newServer(s.store, config)
+	s.Require().NoError(err)
+	server.Close()
+}
+
+// Check that the redirect cache evicts the least recently used and expired entries
+func TestRedirectCacheEviction(t *testing.T) {
+	cache := newRedirectCache(2, time.Hour, 20*time.Millisecond)
+	fetched := 0
+	load := func(short string, fetches int) {
+		link, err := cache.load(short, func() (*Shortlink, error) {
+			fetched++
+			if short == "missing" {
+				return nil, ErrNotFound
+			}
+			return &Shortlink{ID: primitive.NewObjectID(), ShortUrl: short}, nil
+		})
+		if short == "missing" && !isNotFundError(err) {
+			t.Fatalf("Expected a miss loading %s, got %v", short, err)
+		}
+		if short != "missing" && (err != nil || link.ShortUrl != short) {
+			t.Fatalf("Expected shortlink %s, got %v, %v", short, link, err)
+		}
+		if fetched != fetches {
+			t.Fatalf("Expected %d fetches after loading %s, got %d", fetches, short, fetched)
+		}
+	}
+
+	load("a", 1)
+	load("b", 2)
+	load("a", 2)
+	// "b" is the least recently used entry
+	load("c", 3)
+	load("a", 3)
+	load("b", 4)
+
+	// Misses expire after their TTL
+	load("missing", 5)
+	load("missing", 5)
+	time.Sleep(30 * time.Millisecond)
+	load("missing", 6)
+
+	// Shortlinks are cached until they expire at most
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+	expiring := func() (*Shortlink, error) {
+		fetched++
+		return &Shortlink{ID: primitive.NewObjectID(), ShortUrl: "expiring", ExpiresAt: &expiresAt}, nil
+	}
+	cache.load("expiring", expiring)
+	cache.load("expiring", expiring)
+	if fetched != 7 {
+		t.Fatalf("Expected 7 fetches before the shortlink expires, got %d", fetched)
+	}
+	time.Sleep(30 * time.Millisecond)
+	cache.load("expiring", expiring)
+	cache.load("expiring", expiring)
+	if fetched != 9 {
+		t.Fatalf("Expected 9 fetches after the shortlink expired, got %d", fetched)
+	}
+
+	// Shortlinks loaded before an invalidation aren't cached
+	cache.load("d", func() (*Shortlink, error) {
+		cache.invalidate(primitive.NewObjectID())
+		return &Shortlink{ShortUrl: "d"}, nil
+	})
+	load("d", 10)
+	load("d", 10)
+}
+
+// MemoryStore reporting the changes sent via `report` as if made by another instance of the service,
+// or only polled changes if it can't be watched
+type watchedStore struct {
+	*MemoryStore
+	// Changes to watch, nil if unsupported
+	changes chan *ShortlinkChange
+	// Acknowledges watched changes
+	reported chan bool
+	// Changes returned by the next poll
+	polled chan []*ShortlinkChange
+}
+
+func (w *watchedStore) WatchChanges(ctx context.Context, name string, changed func(*ShortlinkChange)) error {
+	if w.changes == nil {
+		return ErrWatchUnsupported
+	}
+	for {
+		select {
+		case change := <-w.changes:
+			changed(change)
+			w.reported <- true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *watchedStore) PollChanges(since time.Time) ([]*ShortlinkChange, time.Time, error) {
+	select {
+	case changes := <-w.polled:
+		return changes, storeTime(), nil
+	default:
+		return nil, storeTime(), nil
+	}
+}
+
+// report sends the change to the watcher and waits until it was handled
+func (w *watchedStore) report(change *ShortlinkChange) {
+	w.changes <- change
+	<-w.reported
+}
+
+// Check that shortlinks changed by other instances are evicted from the redirect cache
+func TestCacheWatcher(t *testing.T) {
+	store := &watchedStore{MemoryStore: NewMemoryStore(), changes: make(chan *ShortlinkChange), reported: make(chan bool)}
+	server, err := newServer(store, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := server.startCacheWatcher()
+	defer stop()
+
+	link := &Shortlink{ShortUrl: "ex", LongUrl: "http://example.com"}
+	if err := store.Create(link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.lookup("ex"); err != nil {
+		t.Fatalf("Expected shortlink ex, got %v", err)
+	}
+	if _, err := server.lookup("new"); !isNotFundError(err) {
+		t.Fatalf("Expected no shortlink new, got %v", err)
+	}
+
+	server.shorts.load(store.GetAllShorts)
+
+	// Changes aren't seen until they are reported
+	if _, err := store.Update("ex", &ShortlinkUpdate{ShortUrl: "new", LongUrl: "http://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.lookup("ex"); err != nil {
+		t.Fatalf("Expected cached shortlink ex, got %v", err)
+	}
+	if shorts, _ := server.shorts.load(store.GetAllShorts); len(shorts) != 1 || shorts[0] != "ex" {
+		t.Fatalf("Expected cached suggested shorts [ex], got %v", shorts)
+	}
+	store.report(&ShortlinkChange{ID: link.ID, Shorts: []string{"new"}})
+	if _, err := server.lookup("ex"); !isNotFundError(err) {
+		t.Fatalf("Expected renamed shortlink ex to be evicted, got %v", err)
+	}
+	if _, err := server.lookup("new"); err != nil {
+		t.Fatalf("Expected miss of shortlink new to be evicted, got %v", err)
+	}
+	if shorts, _ := server.shorts.load(store.GetAllShorts); len(shorts) != 1 || shorts[0] != "new" {
+		t.Fatalf("Expected suggested shorts to be evicted, got %v", shorts)
+	}
+
+	if _, err := store.Delete("new"); err != nil {
+		t.Fatal(err)
+	}
+	store.report(&ShortlinkChange{All: true})
+	if _, err := server.lookup("new"); !isNotFundError(err) {
+		t.Fatalf("Expected all shortlinks to be evicted, got %v", err)
+	}
+}
+
+// Check that changes are polled if the store can't be watched
+func TestCacheWatcherPolling(t *testing.T) {
+	store := &watchedStore{MemoryStore: NewMemoryStore(), polled: make(chan []*ShortlinkChange, 1)}
+	config := DefaultConfig()
+	config.CachePollInterval = 1
+	server, err := newServer(store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := server.startCacheWatcher()
+	defer stop()
+
+	link := &Shortlink{ShortUrl: "ex", LongUrl: "http://example.com"}
+	if err := store.Create(link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.lookup("ex"); err != nil {
+		t.Fatalf("Expected shortlink ex, got %v", err)
+	}
+	if _, err := store.Delete("ex"); err != nil {
+		t.Fatal(err)
+	}
+	store.polled <- []*ShortlinkChange{{ID: link.ID}}
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := server.lookup("ex"); isNotFundError(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected deleted shortlink ex to be evicted after polling")
+		}
+	}
+}
+
+// Check the Prometheus metrics of requests, store operations, the redirect cache and shortlinks
+func (s *S) TestMetrics() {
+	s.createShortlinks("ex", "other")
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	s.Equal(307, s.send("GET", "/go/ex", "").Code)
+	s.Equal(404, s.send("GET", "/go/missing", "").Code)
+	s.Equal(404, s.send("GET", "/go/missing", "").Code)
+	s.Equal(200, s.send("DELETE", "/shortlinks/other", "").Code)
+	s.Equal(404, s.send("GET", "/nothing", "").Code)
+
+	c, b := s.request("GET", "/metrics", "")
+	s.Equal(200, c)
+	s.Contains(b, `shorty_http_requests_total{code="201",method="POST",route="/shortlinks"} 2`)
+	s.Contains(b, `shorty_http_requests_total{code="307",method="GET",route="/go/:short"} 2`)
+	s.Contains(b, `shorty_http_requests_total{code="404",method="GET",route="/go/:short"} 2`)
+	s.Contains(b, `shorty_http_requests_total{code="404",method="GET",route="unmatched"} 1`)
+	s.Contains(b, `shorty_http_request_duration_seconds_count{method="GET",route="/go/:short"} 4`)
+	s.Contains(b, `shorty_store_operation_duration_seconds_count{operation="Create"} 2`)
+	s.Contains(b, `shorty_store_operation_duration_seconds_count{operation="Delete"} 1`)
+	s.NotContains(b, `shorty_store_operation_errors_total`)
+	s.Contains(b, `shorty_redirect_cache_lookups_total{result="hit"} 1`)
+	s.Contains(b, `shorty_redirect_cache_lookups_total{result="negative_hit"} 1`)
+	s.Contains(b, `shorty_redirect_cache_lookups_total{result="miss"} 2`)
+	s.Contains(b, "shorty_shortlinks 1")
+}
+
+// Check the created and updated times
+func (s *S) TestUpdateTimes() {
+	start := now()
+	sl := exampleShortlink()
+	c, _ := s.requestSL("POST", "/shortlinks", sl)
+	s.Equal(201, c)
+
+	c, b := s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, c)
+	r := unmarshalShortlink(b)
+
+	created := r.CreatedAt
+	s.True(before(start, created))
+	s.True(before(created, now()))
+
+	updated := r.UpdatedAt
+	s.True(before(start, updated))
+	s.True(before(updated, now()))
+
+	start_update := now()
+	oldshort := sl.ShortUrl
+	sl.ShortUrl = "newurl"
+	c, b = s.requestSL("PUT", fmt.Sprintf("/shortlinks/%s", oldshort), sl)
+	s.Equal(200, c)
+	r = unmarshalShortlink(b)
+
+	s.Equal(created, r.CreatedAt)
+
+	updated = r.UpdatedAt
+	s.True(before(start_update, updated))
+	s.True(before(updated, now()))
+
+	c, b = s.request("GET", fmt.Sprintf("/shortlinks/%s", sl.ShortUrl), "")
+	s.Equal(200, c)
+	r2 := unmarshalShortlink(b)
+	s.Equal(r, r2)
+}
+
+/* ********************************************** *
+ * ************** MIGRATION TESTS *************** *
+ * ********************************************** */
+
+// Check that the SQLite schema can be migrated down and up again
+func TestSQLiteMigrations(t *testing.T) {
+	store, err := ConnectSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	latest := latestVersion(sqliteMigrations)
+	for _, target := range []int{latest, 0, latest} {
+		if err := store.Migrate(target); err != nil {
+			t.Fatalf("Migrating to version %d: %v", target, err)
+		}
+		version, err := store.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != target {
+			t.Fatalf("Expected schema version %d, got %d", target, version)
+		}
+	}
+
+	if err := store.Migrate(latest + 1); err == nil {
+		t.Fatal("Expected error migrating to unknown version")
+	}
+}
+
+// Check that migrating to version 2 sets the hosts of existing shortlinks, in more than one batch
+func TestSQLiteBackfillHosts(t *testing.T) {
+	store, err := ConnectSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*backfillBatchSize+1; i++ {
+		long := fmt.Sprintf("https://example.com/%d", i)
+		if i%2 == 0 {
+			long = fmt.Sprintf("https://example.org/%d", i)
+		}
+		_, err := store.db.Exec("INSERT INTO shortlinks (id, short, long, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			fmt.Sprintf("%024x", i), fmt.Sprintf("s%d", i), long, time.Now(), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Migrate(latestVersion(sqliteMigrations)); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, expected := range map[string]int{"example.com": backfillBatchSize, "example.org": backfillBatchSize + 1} {
+		var count int
+		if err := store.db.QueryRow("SELECT COUNT(*) FROM shortlinks WHERE host = ?", host).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Fatalf("Expected %d shortlinks with host %s, got %d", expected, host, count)
+		}
+	}
+}
+
+/* ********************************************** *
+ * ***************** BENCHMARKS ***************** *
+ * ********************************************** */
+
+// Measure the throughput of concurrent redirects of a single shortlink
+// with access counts written by every redirect and batched in memory.
+// Run via `go test -run none -bench Redirect`.
+func BenchmarkRedirect(b *testing.B) {
+	stores := []struct {
+		name string
+		open func(dir string) (Store, error)
+	}{
+		{"memory", func(string) (Store, error) { return NewMemoryStore(), nil }},
+		{"sqlite", func(dir string) (Store, error) { return OpenSQLite(filepath.Join(dir, "bench.db")) }},
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.DebugMode)
+	defaultWriter := gin.DefaultWriter
+	gin.DefaultWriter = ioutil.Discard
+	defer func() { gin.DefaultWriter = defaultWriter }()
+
+	for _, st := range stores {
+		for _, interval := range []int{0, 1000} {
+			name := st.name + "/synchronous"
+			if interval > 0 {
+				name = st.name + "/batched"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkRedirect(b, st.open, interval)
+			})
+		}
+	}
+}
+
+// Measure the throughput of redirects against a new store counting them every `interval` milliseconds
+func benchmarkRedirect(b *testing.B, open func(dir string) (Store, error), interval int) {
+	dir, err := ioutil.TempDir("", "shorty-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := open(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	config := DefaultConfig()
+	config.RecordEvents = false
+	config.AccessCountInterval = interval
+	// Measure redirects read from the store
+	config.RedirectCacheSize = 0
+	server, err := newServer(store, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	router := server.router()
+
+	if err := store.Create(&Shortlink{ShortUrl: "bench", LongUrl: "http://example.com"}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/go/bench", nil)
+			router.ServeHTTP(resp, req)
+			if resp.Code != http.StatusTemporaryRedirect {
+				b.Errorf("Unexpected status %d", resp.Code)
+				return
+			}
+		}
+	})
+}
+
+/* ********************************************** *
+ * ************** HELPER FUNCTIONS ************** *
+ * ********************************************** */
+
+// Send a request with the given method/url/body and return the status code and body
+func (s *S) requestSL(method string, url string, body ShortlinkUpdate) (int, string) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		s.Fail("Failed creating request", err)
+	}
+	return s.request(method, url, string(b))
+}
+
+// Send a request with the given method/url/body and return the status code and body
+func (s *S) request(method string, url string, body string) (int, string) {
+	resp := s.send(method, url, body)
+	return resp.Code, resp.Body.String()
+}
+
+// Send a request with the given method/url/body and return the recorded response
+func (s *S) send(method string, url string, body string) *httptest.ResponseRecorder {
+	return s.sendHeader(method, url, body, http.Header{})
+}
+
+// Sends a request with the given headers and returns the recorded response
+func (s *S) sendHeader(method string, url string, body string, header http.Header) *httptest.ResponseRecorder {
+	bodyreader := strings.NewReader(body)
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, bodyreader)
+	if err != nil {
+		s.Fail("Failed creating request", err)
+	}
+	req.Header = header
+	req.Host = "shorty.test"
+	req.RemoteAddr = "192.0.2.1:1234"
+	s.router.ServeHTTP(resp, req)
+
+	return resp
+}
+
+// Unmarshal a string to a Shortlink
+func unmarshalShortlink(body string) Shortlink {
+	sl := Shortlink{}
+	json.Unmarshal([]byte(body), &sl)
+	return sl
+}
+
+// Page of shortlinks as returned by GET /shortlinks
+type shortlinkPage struct {
+	Shortlinks    []Shortlink `json:"shortlinks"`
+	Total         int64       `json:"total"`
+	NextPageToken string      `json:"next_page_token"`
+}
+
+// Unmarshal a string to a page of shortlinks
+func unmarshalShortlinkPage(body string) shortlinkPage {
+	page := shortlinkPage{}
+	json.Unmarshal([]byte(body), &page)
+	return page
+}
+
+// Returns the shorts of the shortlinks on a page
+func shortsOf(page shortlinkPage) []string {
+	shorts := []string{}
+	for _, sl := range page.Shortlinks {
+		shorts = append(shorts, sl.ShortUrl)
+	}
+	return shorts
+}
+
+// Create example shortlinks with the given shorts
+func (s *S) createShortlinks(shorts ...string) {
+	for _, short := range shorts {
+		sl := exampleShortlink()
+		sl.ShortUrl = short
+		c, b := s.requestSL("POST", "/shortlinks", sl)
+		s.Equal(201, c, b)
+	}
+}
+
+// Shortlink "ex" pointing to http://example.com
+func exampleShortlink() ShortlinkUpdate {
 	sl := ShortlinkUpdate{}
 	sl.Description = "Example item"
 	sl.LongUrl = "http://example.com"
@@ -437,6 +2363,12 @@ func exampleShortlink() ShortlinkUpdate {
 	return sl
 }
 
+// Returns the hex encoded hash of a client as in click events
+func clientHash(client int) string {
+	hash := sha256.Sum256([]byte(strconv.Itoa(client)))
+	return hex.EncodeToString(hash[:])
+}
+
 // Returns the current time in millisecond precission
 func now() time.Time {
 	return time.Now().UTC().Round(time.Millisecond)
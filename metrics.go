@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// metrics collects the Prometheus metrics of a server in its own registry,
+// so multiple servers, e.g. in tests, don't share them
+type metrics struct {
+	registry *prometheus.Registry
+	// Requests by method, route and status code
+	requests *prometheus.CounterVec
+	// Duration of requests by method and route
+	requestDuration *prometheus.HistogramVec
+	// Duration of store operations by the name of the Store method
+	storeDuration *prometheus.HistogramVec
+	// Failed store operations by the name of the Store method
+	storeErrors *prometheus.CounterVec
+}
+
+// newMetrics returns the metrics of requests and store operations, including the Go runtime and process metrics
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shorty_http_requests_total",
+			Help: "Number of HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "shorty_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "shorty_store_operation_duration_seconds",
+			Help:    "Duration of store operations by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shorty_store_operation_errors_total",
+			Help: "Number of failed store operations by operation, not counting errors about the state of shortlinks such as not found.",
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(m.requests, m.requestDuration, m.storeDuration, m.storeErrors,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return m
+}
+
+// observeShortlinks adds a gauge of the total number of shortlinks in the store, counted on every scrape
+func (m *metrics) observeShortlinks(store Store) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shorty_shortlinks",
+		Help: "Number of shortlinks, not counting deleted shortlinks.",
+	}, func() float64 {
+		_, total, err := store.ListShortlinks(&ListQuery{Limit: 1})
+		if err != nil {
+			log.Printf("Failed counting shortlinks: %v", err)
+			return math.NaN()
+		}
+		return float64(total)
+	}))
+}
+
+// observeCache adds the lookups and entries of the redirect cache, does nothing if `cache` is nil
+func (m *metrics) observeCache(cache *redirectCache) {
+	if cache == nil {
+		return
+	}
+	for _, result := range []string{cacheHit, cacheNegativeHit, cacheMiss} {
+		result := result
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "shorty_redirect_cache_lookups_total",
+			Help:        "Number of lookups in the redirect cache by result, hit for cached shortlinks, negative_hit for cached misses and miss for lookups in the store.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 {
+			return float64(cache.lookups(result))
+		}))
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shorty_redirect_cache_entries",
+		Help: "Number of shorts in the redirect cache, including misses.",
+	}, func() float64 {
+		return float64(cache.len())
+	}))
+}
+
+// middleware counts and times the requests by their route
+func (m *metrics) middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	m.requestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
+
+// handler serves the metrics in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe records the duration and failure of the store operation started at `start`
+func (m *metrics) observe(operation string, start time.Time, err *error) {
+	m.storeDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil && !isNotFundError(*err) && !isDuplicateError(*err) && !isDisabledError(*err) &&
+		!isScheduledError(*err) && !isExpiredError(*err) {
+		m.storeErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+/* ****************************************** *\
+ * ********** INSTRUMENTED STORES *********** *
+\* ****************************************** */
+
+// instrument returns the store recording the duration and failures of its operations,
+// keeping it a ChangeWatcher if it is one
+func (m *metrics) instrument(store Store) Store {
+	instrumented := &instrumentedStore{store: store, metrics: m}
+	if watcher, ok := store.(ChangeWatcher); ok {
+		return &instrumentedWatcher{instrumentedStore: instrumented, watcher: watcher}
+	}
+	return instrumented
+}
+
+// instrumentedStore is a Store recording the operations of another Store in metrics
+type instrumentedStore struct {
+	store   Store
+	metrics *metrics
+}
+
+func (s *instrumentedStore) ListShortlinks(query *ListQuery) (shortlinks []*Shortlink, total int64, err error) {
+	defer s.metrics.observe("ListShortlinks", time.Now(), &err)
+	return s.store.ListShortlinks(query)
+}
+
+func (s *instrumentedStore) GetAllShorts() (shorts []string, err error) {
+	defer s.metrics.observe("GetAllShorts", time.Now(), &err)
+	return s.store.GetAllShorts()
+}
+
+func (s *instrumentedStore) GetShortlinkByShort(short string) (shortlink *Shortlink, err error) {
+	defer s.metrics.observe("GetShortlinkByShort", time.Now(), &err)
+	return s.store.GetShortlinkByShort(short)
+}
+
+func (s *instrumentedStore) Create(shortlink *Shortlink) (err error) {
+	defer s.metrics.observe("Create", time.Now(), &err)
+	return s.store.Create(shortlink)
+}
+
+func (s *instrumentedStore) Update(short string, shortlink *ShortlinkUpdate) (updated *Shortlink, err error) {
+	defer s.metrics.observe("Update", time.Now(), &err)
+	return s.store.Update(short, shortlink)
+}
+
+func (s *instrumentedStore) Delete(short string) (deleted int64, err error) {
+	defer s.metrics.observe("Delete", time.Now(), &err)
+	return s.store.Delete(short)
+}
+
+func (s *instrumentedStore) ListTrash(offset int, limit int) (shortlinks []*Shortlink, total int64, err error) {
+	defer s.metrics.observe("ListTrash", time.Now(), &err)
+	return s.store.ListTrash(offset, limit)
+}
+
+func (s *instrumentedStore) IsTrashed(short string) (trashed bool, err error) {
+	defer s.metrics.observe("IsTrashed", time.Now(), &err)
+	return s.store.IsTrashed(short)
+}
+
+func (s *instrumentedStore) Restore(short string) (shortlink *Shortlink, err error) {
+	defer s.metrics.observe("Restore", time.Now(), &err)
+	return s.store.Restore(short)
+}
+
+func (s *instrumentedStore) PurgeTrash(before time.Time) (deleted int64, err error) {
+	defer s.metrics.observe("PurgeTrash", time.Now(), &err)
+	return s.store.PurgeTrash(before)
+}
+
+func (s *instrumentedStore) AddRevision(revision *Revision) (err error) {
+	defer s.metrics.observe("AddRevision", time.Now(), &err)
+	return s.store.AddRevision(revision)
+}
+
+func (s *instrumentedStore) ListRevisions(id primitive.ObjectID) (revisions []*Revision, err error) {
+	defer s.metrics.observe("ListRevisions", time.Now(), &err)
+	return s.store.ListRevisions(id)
+}
+
+func (s *instrumentedStore) GetRedirect(short string) (shortlink *Shortlink, err error) {
+	defer s.metrics.observe("GetRedirect", time.Now(), &err)
+	return s.store.GetRedirect(short)
+}
+
+func (s *instrumentedStore) IncrementAccessCounts(counts map[primitive.ObjectID]int) (err error) {
+	defer s.metrics.observe("IncrementAccessCounts", time.Now(), &err)
+	return s.store.IncrementAccessCounts(counts)
+}
+
+func (s *instrumentedStore) IsFree(short string) (free bool, err error) {
+	defer s.metrics.observe("IsFree", time.Now(), &err)
+	return s.store.IsFree(short)
+}
+
+func (s *instrumentedStore) Search(query string, limit int) (shortlinks []*Shortlink, err error) {
+	defer s.metrics.observe("Search", time.Now(), &err)
+	return s.store.Search(query, limit)
+}
+
+func (s *instrumentedStore) SetNormalizeShorts(enabled bool) (err error) {
+	defer s.metrics.observe("SetNormalizeShorts", time.Now(), &err)
+	return s.store.SetNormalizeShorts(enabled)
+}
+
+func (s *instrumentedStore) PurgeExpired() (deleted int64, err error) {
+	defer s.metrics.observe("PurgeExpired", time.Now(), &err)
+	return s.store.PurgeExpired()
+}
+
+func (s *instrumentedStore) Close() (err error) {
+	defer s.metrics.observe("Close", time.Now(), &err)
+	return s.store.Close()
+}
+
+func (s *instrumentedStore) AddEvents(events []*ClickEvent) (err error) {
+	defer s.metrics.observe("AddEvents", time.Now(), &err)
+	return s.store.AddEvents(events)
+}
+
+func (s *instrumentedStore) ListEvents(id primitive.ObjectID, limit int) (events []*ClickEvent, err error) {
+	defer s.metrics.observe("ListEvents", time.Now(), &err)
+	return s.store.ListEvents(id, limit)
+}
+
+func (s *instrumentedStore) PurgeEvents(before time.Time) (deleted int64, err error) {
+	defer s.metrics.observe("PurgeEvents", time.Now(), &err)
+	return s.store.PurgeEvents(before)
+}
+
+func (s *instrumentedStore) ClickRollups(id primitive.ObjectID, from time.Time, to time.Time) (rollups []*ClickRollup, err error) {
+	defer s.metrics.observe("ClickRollups", time.Now(), &err)
+	return s.store.ClickRollups(id, from, to)
+}
+
+// instrumentedWatcher is an instrumentedStore of a ChangeWatcher,
+// only polls are recorded as watching changes lasts until it fails
+type instrumentedWatcher struct {
+	*instrumentedStore
+	watcher ChangeWatcher
+}
+
+func (s *instrumentedWatcher) WatchChanges(ctx context.Context, name string, changed func(*ShortlinkChange)) error {
+	return s.watcher.WatchChanges(ctx, name, changed)
+}
+
+func (s *instrumentedWatcher) PollChanges(since time.Time) (changes []*ShortlinkChange, next time.Time, err error) {
+	defer s.metrics.observe("PollChanges", time.Now(), &err)
+	return s.watcher.PollChanges(since)
+}
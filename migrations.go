@@ -0,0 +1,584 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A versioned schema migration of an SQL database.
+// Migrations are applied in order of their version, `down` reverts `up`.
+type migration struct {
+	version int
+	up      string
+	down    string
+	// Migrates existing data after `up` has been applied, optional
+	data func(tx *sql.Tx, s *SQLStore) error
+}
+
+// Migrations of the SQLite schema
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		up: `
+CREATE TABLE IF NOT EXISTS shortlinks (
+	id           TEXT PRIMARY KEY,
+	short        TEXT NOT NULL,
+	long         TEXT NOT NULL,
+	descr        TEXT NOT NULL DEFAULT '',
+	access_count INTEGER NOT NULL DEFAULT 0,
+	created_at   TIMESTAMP NOT NULL,
+	updated_at   TIMESTAMP NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS shortlinks_short ON shortlinks (short);`,
+		down: `DROP TABLE shortlinks;`,
+	},
+	{
+		version: 2,
+		up: `
+ALTER TABLE shortlinks ADD COLUMN host TEXT NOT NULL DEFAULT '';
+CREATE INDEX shortlinks_host ON shortlinks (host);
+CREATE INDEX shortlinks_created_at ON shortlinks (created_at);
+CREATE INDEX shortlinks_updated_at ON shortlinks (updated_at);
+CREATE INDEX shortlinks_access_count ON shortlinks (access_count);`,
+		down: `
+DROP INDEX shortlinks_host;
+DROP INDEX shortlinks_created_at;
+DROP INDEX shortlinks_updated_at;
+DROP INDEX shortlinks_access_count;
+ALTER TABLE shortlinks DROP COLUMN host;`,
+		data: backfillHosts,
+	},
+	{
+		version: 3,
+		up: `
+CREATE VIRTUAL TABLE shortlinks_fts USING fts4(id, short, descr, long, notindexed=id);
+INSERT INTO shortlinks_fts (id, short, descr, long) SELECT id, short, descr, long FROM shortlinks;
+CREATE TRIGGER shortlinks_fts_insert AFTER INSERT ON shortlinks BEGIN
+	INSERT INTO shortlinks_fts (id, short, descr, long) VALUES (new.id, new.short, new.descr, new.long);
+END;
+CREATE TRIGGER shortlinks_fts_update AFTER UPDATE OF short, descr, long ON shortlinks BEGIN
+	DELETE FROM shortlinks_fts WHERE id = old.id;
+	INSERT INTO shortlinks_fts (id, short, descr, long) VALUES (new.id, new.short, new.descr, new.long);
+END;
+CREATE TRIGGER shortlinks_fts_delete AFTER DELETE ON shortlinks BEGIN
+	DELETE FROM shortlinks_fts WHERE id = old.id;
+END;`,
+		down: `
+DROP TRIGGER shortlinks_fts_insert;
+DROP TRIGGER shortlinks_fts_update;
+DROP TRIGGER shortlinks_fts_delete;
+DROP TABLE shortlinks_fts;`,
+	},
+	{
+		version: 4,
+		up:      `ALTER TABLE shortlinks ADD COLUMN forward BOOLEAN NOT NULL DEFAULT FALSE;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN forward;`,
+	},
+	{
+		version: 5,
+		up:      `ALTER TABLE shortlinks ADD COLUMN redirect_type INTEGER NOT NULL DEFAULT 0;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN redirect_type;`,
+	},
+	{
+		version: 6,
+		up: `
+ALTER TABLE shortlinks ADD COLUMN expires_at TIMESTAMP;
+ALTER TABLE shortlinks ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX shortlinks_expires_at ON shortlinks (expires_at);`,
+		down: `
+DROP INDEX shortlinks_expires_at;
+ALTER TABLE shortlinks DROP COLUMN expires_at;
+ALTER TABLE shortlinks DROP COLUMN max_clicks;`,
+	},
+	{
+		version: 7,
+		up:      `ALTER TABLE shortlinks ADD COLUMN active_from TIMESTAMP;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN active_from;`,
+	},
+	{
+		version: 8,
+		up:      `ALTER TABLE shortlinks ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN disabled;`,
+	},
+	{
+		// Deleted shortlinks, columns added to shortlinks must be added here as well
+		version: 9,
+		up: `
+CREATE TABLE trash (
+	id            TEXT PRIMARY KEY,
+	short         TEXT NOT NULL,
+	long          TEXT NOT NULL,
+	descr         TEXT NOT NULL DEFAULT '',
+	access_count  INTEGER NOT NULL DEFAULT 0,
+	created_at    TIMESTAMP NOT NULL,
+	updated_at    TIMESTAMP NOT NULL,
+	host          TEXT NOT NULL DEFAULT '',
+	forward       BOOLEAN NOT NULL DEFAULT FALSE,
+	redirect_type INTEGER NOT NULL DEFAULT 0,
+	disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+	active_from   TIMESTAMP,
+	expires_at    TIMESTAMP,
+	max_clicks    INTEGER NOT NULL DEFAULT 0,
+	deleted_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX trash_short ON trash (short);
+CREATE INDEX trash_deleted_at ON trash (deleted_at);`,
+		down: `DROP TABLE trash;`,
+	},
+	{
+		// Revisions of shortlinks, columns of ShortlinkUpdate added to shortlinks must be added here as well
+		version: 10,
+		up: `
+CREATE TABLE revisions (
+	shortlink_id  TEXT NOT NULL,
+	rev           INTEGER NOT NULL,
+	action        TEXT NOT NULL,
+	author        TEXT NOT NULL DEFAULT '',
+	created_at    TIMESTAMP NOT NULL,
+	reverted_to   INTEGER NOT NULL DEFAULT 0,
+	short         TEXT NOT NULL,
+	long          TEXT NOT NULL,
+	descr         TEXT NOT NULL DEFAULT '',
+	forward       BOOLEAN NOT NULL DEFAULT FALSE,
+	redirect_type INTEGER NOT NULL DEFAULT 0,
+	disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+	active_from   TIMESTAMP,
+	expires_at    TIMESTAMP,
+	max_clicks    INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (shortlink_id, rev)
+);`,
+		down: `DROP TABLE revisions;`,
+	},
+	{
+		// Shorts and aliases of all shortlinks, the primary key enforces their uniqueness across shortlinks
+		version: 11,
+		up: `
+ALTER TABLE shortlinks ADD COLUMN aliases TEXT NOT NULL DEFAULT '';
+ALTER TABLE trash ADD COLUMN aliases TEXT NOT NULL DEFAULT '';
+ALTER TABLE revisions ADD COLUMN aliases TEXT NOT NULL DEFAULT '';
+CREATE TABLE shorts (
+	short        TEXT PRIMARY KEY,
+	shortlink_id TEXT NOT NULL
+);
+CREATE INDEX shorts_shortlink_id ON shorts (shortlink_id);
+INSERT INTO shorts (short, shortlink_id) SELECT short, id FROM shortlinks;`,
+		down: `
+DROP TABLE shorts;
+ALTER TABLE revisions DROP COLUMN aliases;
+ALTER TABLE trash DROP COLUMN aliases;
+ALTER TABLE shortlinks DROP COLUMN aliases;`,
+	},
+	{
+		// Normalized keys of shorts and aliases, unique if enabled by SetNormalizeShorts
+		version: 12,
+		up: `
+ALTER TABLE shorts ADD COLUMN short_key TEXT NOT NULL DEFAULT '';
+UPDATE shorts SET short_key = LOWER(REPLACE(short, '_', '-'));
+CREATE INDEX shorts_short_key ON shorts (short_key);`,
+		down: `
+DROP INDEX IF EXISTS ` + uniqueShortKeyIndex + `;
+DROP INDEX shorts_short_key;
+ALTER TABLE shorts DROP COLUMN short_key;`,
+	},
+	{
+		// Click events of redirects
+		version: 13,
+		up: `
+CREATE TABLE events (
+	shortlink_id    TEXT NOT NULL,
+	short           TEXT NOT NULL,
+	clicked_at      TIMESTAMP NOT NULL,
+	referrer        TEXT NOT NULL DEFAULT '',
+	user_agent      TEXT NOT NULL DEFAULT '',
+	client_hash     TEXT NOT NULL DEFAULT '',
+	accept_language TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX events_shortlink_id_clicked_at ON events (shortlink_id, clicked_at);
+CREATE INDEX events_clicked_at ON events (clicked_at);`,
+		down: `DROP TABLE events;`,
+	},
+	{
+		// Hourly rollups of click events
+		version: 14,
+		up: `
+CREATE TABLE click_stats (
+	shortlink_id TEXT NOT NULL,
+	hour         TIMESTAMP NOT NULL,
+	clicks       INTEGER NOT NULL DEFAULT 0,
+	visitors     BLOB NOT NULL,
+	PRIMARY KEY (shortlink_id, hour)
+);
+CREATE TABLE click_counts (
+	shortlink_id TEXT NOT NULL,
+	hour         TIMESTAMP NOT NULL,
+	kind         TEXT NOT NULL,
+	name         TEXT NOT NULL,
+	clicks       INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (shortlink_id, hour, kind, name)
+);`,
+		down: `
+DROP TABLE click_counts;
+DROP TABLE click_stats;`,
+	},
+}
+
+// Migrations of the PostgreSQL schema
+var postgresMigrations = []migration{
+	{
+		version: 1,
+		up: `
+CREATE TABLE shortlinks (
+	id           TEXT PRIMARY KEY,
+	short        TEXT NOT NULL,
+	long         TEXT NOT NULL,
+	descr        TEXT NOT NULL DEFAULT '',
+	access_count BIGINT NOT NULL DEFAULT 0,
+	created_at   TIMESTAMPTZ NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL
+);
+CREATE UNIQUE INDEX shortlinks_short ON shortlinks (short);`,
+		down: `DROP TABLE shortlinks;`,
+	},
+	{
+		version: 2,
+		up: `
+ALTER TABLE shortlinks ADD COLUMN host TEXT NOT NULL DEFAULT '';
+CREATE INDEX shortlinks_host ON shortlinks (host);
+CREATE INDEX shortlinks_created_at ON shortlinks (created_at);
+CREATE INDEX shortlinks_updated_at ON shortlinks (updated_at);
+CREATE INDEX shortlinks_access_count ON shortlinks (access_count);`,
+		down: `
+DROP INDEX shortlinks_host;
+DROP INDEX shortlinks_created_at;
+DROP INDEX shortlinks_updated_at;
+DROP INDEX shortlinks_access_count;
+ALTER TABLE shortlinks DROP COLUMN host;`,
+		data: backfillHosts,
+	},
+	{
+		version: 3,
+		up: `
+CREATE INDEX shortlinks_search ON shortlinks USING GIN (` + postgresSearchVector + `);`,
+		down: `DROP INDEX shortlinks_search;`,
+	},
+	{
+		version: 4,
+		up:      `ALTER TABLE shortlinks ADD COLUMN forward BOOLEAN NOT NULL DEFAULT FALSE;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN forward;`,
+	},
+	{
+		version: 5,
+		up:      `ALTER TABLE shortlinks ADD COLUMN redirect_type INTEGER NOT NULL DEFAULT 0;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN redirect_type;`,
+	},
+	{
+		version: 6,
+		up: `
+ALTER TABLE shortlinks ADD COLUMN expires_at TIMESTAMPTZ;
+ALTER TABLE shortlinks ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX shortlinks_expires_at ON shortlinks (expires_at);`,
+		down: `
+DROP INDEX shortlinks_expires_at;
+ALTER TABLE shortlinks DROP COLUMN expires_at;
+ALTER TABLE shortlinks DROP COLUMN max_clicks;`,
+	},
+	{
+		version: 7,
+		up:      `ALTER TABLE shortlinks ADD COLUMN active_from TIMESTAMPTZ;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN active_from;`,
+	},
+	{
+		version: 8,
+		up:      `ALTER TABLE shortlinks ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;`,
+		down:    `ALTER TABLE shortlinks DROP COLUMN disabled;`,
+	},
+	{
+		// Deleted shortlinks, columns added to shortlinks must be added here as well
+		version: 9,
+		up: `
+CREATE TABLE trash (
+	id            TEXT PRIMARY KEY,
+	short         TEXT NOT NULL,
+	long          TEXT NOT NULL,
+	descr         TEXT NOT NULL DEFAULT '',
+	access_count  BIGINT NOT NULL DEFAULT 0,
+	created_at    TIMESTAMPTZ NOT NULL,
+	updated_at    TIMESTAMPTZ NOT NULL,
+	host          TEXT NOT NULL DEFAULT '',
+	forward       BOOLEAN NOT NULL DEFAULT FALSE,
+	redirect_type INTEGER NOT NULL DEFAULT 0,
+	disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+	active_from   TIMESTAMPTZ,
+	expires_at    TIMESTAMPTZ,
+	max_clicks    INTEGER NOT NULL DEFAULT 0,
+	deleted_at    TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX trash_short ON trash (short);
+CREATE INDEX trash_deleted_at ON trash (deleted_at);`,
+		down: `DROP TABLE trash;`,
+	},
+	{
+		// Revisions of shortlinks, columns of ShortlinkUpdate added to shortlinks must be added here as well
+		version: 10,
+		up: `
+CREATE TABLE revisions (
+	shortlink_id  TEXT NOT NULL,
+	rev           INTEGER NOT NULL,
+	action        TEXT NOT NULL,
+	author        TEXT NOT NULL DEFAULT '',
+	created_at    TIMESTAMPTZ NOT NULL,
+	reverted_to   INTEGER NOT NULL DEFAULT 0,
+	short         TEXT NOT NULL,
+	long          TEXT NOT NULL,
+	descr         TEXT NOT NULL DEFAULT '',
+	forward       BOOLEAN NOT NULL DEFAULT FALSE,
+	redirect_type INTEGER NOT NULL DEFAULT 0,
+	disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+	active_from   TIMESTAMPTZ,
+	expires_at    TIMESTAMPTZ,
+	max_clicks    INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (shortlink_id, rev)
+);`,
+		down: `DROP TABLE revisions;`,
+	},
+	{
+		// Shorts and aliases of all shortlinks, the primary key enforces their uniqueness across shortlinks
+		version: 11,
+		up: `
+ALTER TABLE shortlinks ADD COLUMN aliases TEXT NOT NULL DEFAULT '';
+ALTER TABLE trash ADD COLUMN aliases TEXT NOT NULL DEFAULT '';
+ALTER TABLE revisions ADD COLUMN aliases TEXT NOT NULL DEFAULT '';
+CREATE TABLE shorts (
+	short        TEXT PRIMARY KEY,
+	shortlink_id TEXT NOT NULL
+);
+CREATE INDEX shorts_shortlink_id ON shorts (shortlink_id);
+INSERT INTO shorts (short, shortlink_id) SELECT short, id FROM shortlinks;`,
+		down: `
+DROP TABLE shorts;
+ALTER TABLE revisions DROP COLUMN aliases;
+ALTER TABLE trash DROP COLUMN aliases;
+ALTER TABLE shortlinks DROP COLUMN aliases;`,
+	},
+	{
+		// Normalized keys of shorts and aliases, unique if enabled by SetNormalizeShorts
+		version: 12,
+		up: `
+ALTER TABLE shorts ADD COLUMN short_key TEXT NOT NULL DEFAULT '';
+UPDATE shorts SET short_key = LOWER(REPLACE(short, '_', '-'));
+CREATE INDEX shorts_short_key ON shorts (short_key);`,
+		down: `
+DROP INDEX IF EXISTS ` + uniqueShortKeyIndex + `;
+DROP INDEX shorts_short_key;
+ALTER TABLE shorts DROP COLUMN short_key;`,
+	},
+	{
+		// Click events of redirects
+		version: 13,
+		up: `
+CREATE TABLE events (
+	shortlink_id    TEXT NOT NULL,
+	short           TEXT NOT NULL,
+	clicked_at      TIMESTAMPTZ NOT NULL,
+	referrer        TEXT NOT NULL DEFAULT '',
+	user_agent      TEXT NOT NULL DEFAULT '',
+	client_hash     TEXT NOT NULL DEFAULT '',
+	accept_language TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX events_shortlink_id_clicked_at ON events (shortlink_id, clicked_at);
+CREATE INDEX events_clicked_at ON events (clicked_at);`,
+		down: `DROP TABLE events;`,
+	},
+	{
+		// Hourly rollups of click events
+		version: 14,
+		up: `
+CREATE TABLE click_stats (
+	shortlink_id TEXT NOT NULL,
+	hour         TIMESTAMPTZ NOT NULL,
+	clicks       BIGINT NOT NULL DEFAULT 0,
+	visitors     BYTEA NOT NULL,
+	PRIMARY KEY (shortlink_id, hour)
+);
+CREATE TABLE click_counts (
+	shortlink_id TEXT NOT NULL,
+	hour         TIMESTAMPTZ NOT NULL,
+	kind         TEXT NOT NULL,
+	name         TEXT NOT NULL,
+	clicks       BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (shortlink_id, hour, kind, name)
+);`,
+		down: `
+DROP TABLE click_counts;
+DROP TABLE click_stats;`,
+	},
+}
+
+// Document searched in PostgreSQL, the same expression must be used in queries to use the index
+const postgresSearchVector = `to_tsvector('simple', regexp_replace(short || ' ' || descr || ' ' || long, '[^[:alnum:]]+', ' ', 'g'))`
+
+// Table keeping track of the applied migrations
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`
+
+// latestVersion returns the highest version of the migrations
+func latestVersion(migrations []migration) int {
+	version := 0
+	for _, m := range migrations {
+		if m.version > version {
+			version = m.version
+		}
+	}
+	return version
+}
+
+// Migrate migrates the schema of the database up or down to the `target` version.
+// The current version is kept in the table schema_migrations.
+// All required migrations are applied in a single transaction.
+func (s *SQLStore) Migrate(target int) error {
+	// Migrations of large databases take longer than the timeout of other operations
+	ctx := UnboundContext()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Prevent concurrent migrations, e.g. by multiple replicas starting at once
+	if s.dialect.lockMigrations != "" {
+		if _, err := tx.ExecContext(ctx, s.dialect.lockMigrations); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, createSchemaMigrations)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	migrations := s.dialect.migrations
+	if target < 0 || target > latestVersion(migrations) {
+		return fmt.Errorf("unknown schema version %d", target)
+	}
+
+	// Apply pending migrations in ascending order when migrating up
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		log.Printf("Migrating schema up to version %d", m.version)
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			return fmt.Errorf("migrating up to version %d: %w", m.version, err)
+		}
+		if m.data != nil {
+			if err := m.data(tx, s); err != nil {
+				return fmt.Errorf("migrating data to version %d: %w", m.version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind("INSERT INTO schema_migrations (version) VALUES (?)"), m.version); err != nil {
+			return err
+		}
+	}
+
+	// Revert applied migrations in descending order when migrating down
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		log.Printf("Migrating schema down from version %d", m.version)
+		if _, err := tx.ExecContext(ctx, m.down); err != nil {
+			return fmt.Errorf("migrating down from version %d: %w", m.version, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM schema_migrations WHERE version = ?"), m.version); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SchemaVersion returns the current version of the database schema, 0 if no migrations have been applied
+func (s *SQLStore) SchemaVersion() (int, error) {
+	ctx, cancel := TimedContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, createSchemaMigrations)
+	if err != nil {
+		return 0, err
+	}
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// schemaVersion reads the current version from the schema_migrations table
+func schemaVersion(tx *sql.Tx) (int, error) {
+	var version sql.NullInt64
+	err := tx.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+/* ****************************************** *\
+ * ************ DATA MIGRATIONS ************* *
+\* ****************************************** */
+
+// Number of shortlinks updated at once by data migrations
+const backfillBatchSize = 500
+
+// backfillHosts sets the host column of all existing shortlinks
+func backfillHosts(tx *sql.Tx, s *SQLStore) error {
+	rows, err := tx.Query("SELECT id, long FROM shortlinks")
+	if err != nil {
+		return err
+	}
+	// IDs of the shortlinks by their host, as most shortlinks share a few hosts
+	ids := map[string][]interface{}{}
+	for rows.Next() {
+		var id, long string
+		if err := rows.Scan(&id, &long); err != nil {
+			rows.Close()
+			return err
+		}
+		host := linkHost(long)
+		ids[host] = append(ids[host], id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Update the shortlinks of a host in batches
+	for host, hostIDs := range ids {
+		for start := 0; start < len(hostIDs); start += backfillBatchSize {
+			end := start + backfillBatchSize
+			if end > len(hostIDs) {
+				end = len(hostIDs)
+			}
+			batch := hostIDs[start:end]
+			query := "UPDATE shortlinks SET host = ? WHERE id IN (?" + strings.Repeat(", ?", len(batch)-1) + ")"
+			if _, err := tx.Exec(s.rebind(query), append([]interface{}{host}, batch...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"html/template"
+)
+
+// HTML pages served to browsers
+
+// Common head of all pages
+const pageHead = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+a { color: #0b57d0; }
+label { display: block; margin-top: 1em; }
+input { width: 100%; padding: .4em; box-sizing: border-box; }
+button { margin-top: 1em; padding: .4em 1em; }
+.error { color: #b3261e; }
+</style>
+</head>
+<body>
+`
+
+// Page shown if a redirect doesn't exist, listing similar shorts
+var notFoundPage = template.Must(template.New("notfound").Parse(pageHead + `
+<h1>go/{{.Short}} does not exist</h1>
+{{if .Suggestions}}
+<p>Did you mean</p>
+<ul>
+{{range .Suggestions}}<li><a href="/go/{{.}}">go/{{.}}</a></li>
+{{end}}
+</ul>
+{{end}}
+<p><a href="/new?short={{.Short}}">Create go/{{.Short}}</a></p>
+</body>
+</html>
+`))
+
+// Page with a form to create a shortlink
+var newPage = template.Must(template.New("new").Parse(pageHead + `
+<h1>Create a shortlink</h1>
+<form id="create">
+<label>Short <input name="short" value="{{.Short}}" pattern="[a-zA-Z0-9\-_]+" required></label>
+<label>Target URL <input name="long" type="url" placeholder="https://" required autofocus></label>
+<label>Description <input name="descr"></label>
+<button type="submit">Create</button>
+<p class="error" id="error"></p>
+</form>
+<script>
+document.getElementById("create").addEventListener("submit", function (e) {
+	e.preventDefault();
+	var form = e.target;
+	fetch("/shortlinks", {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ short: form.short.value, long: form.long.value, descr: form.descr.value })
+	}).then(function (resp) {
+		if (resp.ok) {
+			window.location = "/go/" + form.short.value;
+			return;
+		}
+		return resp.json().then(function (body) {
+			document.getElementById("error").textContent = body.error;
+		});
+	});
+});
+</script>
+</body>
+</html>
+`))
+
+// Page shown if a shortlink isn't active yet
+var comingSoonPage = template.Must(template.New("comingsoon").Parse(pageHead + `
+<h1>go/{{.Short}} is coming soon</h1>
+<p>This shortlink redirects from {{.ActiveFrom}} on.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Maximum interval between purges of the trash and of click events
+const retentionPurgeInterval = time.Hour
+
+// startReaper purges expired shortlinks from the store every `interval`
+// until the returned function is called
+func startReaper(store Store, interval time.Duration) func() {
+	return every(interval, func() {
+		deleted, err := store.PurgeExpired()
+		if err != nil {
+			log.Printf("Failed purging expired shortlinks: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d expired shortlinks", deleted)
+		}
+	})
+}
+
+// startTrashReaper permanently deletes shortlinks that were deleted longer than `retention` ago
+// until the returned function is called
+func startTrashReaper(store Store, retention time.Duration) func() {
+	return every(retentionInterval(retention), func() {
+		deleted, err := store.PurgeTrash(storeTime().Add(-retention))
+		if err != nil {
+			log.Printf("Failed purging the trash: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d deleted shortlinks from the trash", deleted)
+		}
+	})
+}
+
+// startEventReaper deletes click events recorded longer than `retention` ago
+// until the returned function is called
+func startEventReaper(store EventStore, retention time.Duration) func() {
+	return every(retentionInterval(retention), func() {
+		deleted, err := store.PurgeEvents(storeTime().Add(-retention))
+		if err != nil {
+			log.Printf("Failed purging click events: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d click events", deleted)
+		}
+	})
+}
+
+// retentionInterval returns the interval between purges of data kept for `retention`
+func retentionInterval(retention time.Duration) time.Duration {
+	if retention < retentionPurgeInterval {
+		return retention
+	}
+	return retentionPurgeInterval
+}
+
+// every runs `task` every `interval` until the returned function is called
+func every(interval time.Duration, task func()) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				task()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
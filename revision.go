@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Actions recorded as revisions of a shortlink
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+	RevisionRevert  = "revert"
+)
+
+// Revision of a shortlink recorded for every change
+type Revision struct {
+	// ID of the changed shortlink, stays the same when its short is changed
+	ShortlinkID primitive.ObjectID `json:"-" bson:"shortlink_id"`
+	// Number of the revision, counting up from 1 per shortlink
+	Rev int `json:"rev" bson:"rev"`
+	// One of the Revision* actions
+	Action string `json:"action" bson:"action"`
+	// User who made the change, empty if unknown
+	Author    string    `json:"author,omitempty" bson:"author"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	// Revision restored by a revert
+	RevertedTo int `json:"reverted_to,omitempty" bson:"reverted_to,omitempty"`
+	// Data of the shortlink after the change
+	Shortlink ShortlinkUpdate `json:"-" bson:"shortlink"`
+}
+
+// Change of a field of a shortlink between two revisions
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// RevisionResponse is the API representation of a revision including the changes to the previous revision
+type RevisionResponse struct {
+	*Revision
+	Short   string             `json:"short"`
+	Changes map[string]*Change `json:"changes"`
+}
+
+// snapshot returns the data of the shortlink recorded in a revision
+func snapshot(l *Shortlink) ShortlinkUpdate {
+	return ShortlinkUpdate{
+		ShortUrl:     l.ShortUrl,
+		LongUrl:      l.LongUrl,
+		Description:  l.Description,
+		Aliases:      l.Aliases,
+		Forward:      l.Forward,
+		RedirectType: l.RedirectType,
+		Disabled:     l.Disabled,
+		ActiveFrom:   l.ActiveFrom,
+		ExpiresAt:    l.ExpiresAt,
+		MaxClicks:    l.MaxClicks,
+	}
+}
+
+// revisionResponses returns the API representation of the revisions of a shortlink, oldest first
+func revisionResponses(revisions []*Revision) ([]*RevisionResponse, error) {
+	responses := make([]*RevisionResponse, len(revisions))
+	previous := &ShortlinkUpdate{}
+	for i, revision := range revisions {
+		changed, err := changes(previous, &revision.Shortlink)
+		if err != nil {
+			return nil, err
+		}
+		responses[i] = &RevisionResponse{
+			Revision: revision,
+			Short:    revision.Shortlink.ShortUrl,
+			Changes:  changed,
+		}
+		previous = &revision.Shortlink
+	}
+	return responses, nil
+}
+
+// changes returns the fields that differ between two versions of a shortlink by their API names
+func changes(before, after *ShortlinkUpdate) (map[string]*Change, error) {
+	from, err := fieldValues(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := fieldValues(after)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]*Change{}
+	for field := range from {
+		if !reflect.DeepEqual(from[field], to[field]) {
+			result[field] = &Change{From: from[field], To: to[field]}
+		}
+	}
+	for field := range to {
+		if _, ok := from[field]; !ok {
+			result[field] = &Change{To: to[field]}
+		}
+	}
+	return result, nil
+}
+
+// fieldValues returns the fields of a version of a shortlink by their API names, without updated_at
+func fieldValues(shortlink *ShortlinkUpdate) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	b, err := json.Marshal(shortlink)
+	if err == nil {
+		err = json.Unmarshal(b, &values)
+	}
+	if err != nil {
+		return nil, err
+	}
+	delete(values, "updated_at")
+	return values, nil
+}
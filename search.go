@@ -0,0 +1,166 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Maximum number of text matches a Store considers for ranking
+const maxSearchCandidates = 200
+
+// Separates the terms of a search query
+var searchSeparator = regexp.MustCompile("[^a-z0-9]+")
+
+// searchTerms splits a search query into its lower case alphanumeric terms
+func searchTerms(query string) []string {
+	terms := []string{}
+	for _, term := range searchSeparator.Split(strings.ToLower(query), -1) {
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// rankSearchResults orders shortlinks found for a search query by relevance:
+// Exact matches of the short first, followed by shorts starting with the query and
+// shortlinks whose short, description or target URL contain terms of the query.
+// Duplicates and shortlinks not matching the query are dropped and at most `limit` shortlinks are returned.
+func rankSearchResults(query string, candidates []*Shortlink, limit int) []*Shortlink {
+	type result struct {
+		shortlink *Shortlink
+		rank      int
+		score     int
+	}
+
+	query = strings.ToLower(query)
+	terms := searchTerms(query)
+
+	seen := map[string]bool{}
+	results := []result{}
+	for _, shortlink := range candidates {
+		if seen[shortlink.ID.Hex()] {
+			continue
+		}
+		seen[shortlink.ID.Hex()] = true
+
+		short := strings.ToLower(shortlink.ShortUrl)
+		r := result{shortlink: shortlink, rank: 2}
+		switch {
+		case short == query:
+			r.rank = 0
+		case strings.HasPrefix(short, query):
+			r.rank = 1
+		}
+
+		// Matches in the short weigh more than in the description and the target URL
+		descr := strings.ToLower(shortlink.Description)
+		long := strings.ToLower(shortlink.LongUrl)
+		for _, term := range terms {
+			if strings.Contains(short, term) {
+				r.score += 3
+			}
+			if strings.Contains(descr, term) {
+				r.score += 2
+			}
+			if strings.Contains(long, term) {
+				r.score++
+			}
+		}
+
+		if r.rank < 2 || r.score > 0 {
+			results = append(results, r)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].rank != results[j].rank {
+			return results[i].rank < results[j].rank
+		}
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].shortlink.ShortUrl < results[j].shortlink.ShortUrl
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	shortlinks := make([]*Shortlink, len(results))
+	for i, r := range results {
+		shortlinks[i] = r.shortlink
+	}
+	return shortlinks
+}
+
+// suggestShorts returns up to `limit` of the existing shorts close to `short`,
+// i.e. differing by few edits or where one is a prefix of the other, closest first.
+func suggestShorts(short string, shorts []string, limit int) []string {
+	type suggestion struct {
+		short    string
+		distance int
+	}
+
+	short = strings.ToLower(short)
+	// Allow one edit per three characters, at least one
+	maxDistance := len(short) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	suggestions := []suggestion{}
+	for _, candidate := range shorts {
+		lower := strings.ToLower(candidate)
+		distance := editDistance(short, lower)
+		prefix := len(short) > 1 && (strings.HasPrefix(lower, short) || strings.HasPrefix(short, lower))
+		if distance <= maxDistance || prefix {
+			suggestions = append(suggestions, suggestion{candidate, distance})
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].short < suggestions[j].short
+	})
+
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	result := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		result[i] = s.short
+	}
+	return result
+}
+
+// editDistance returns the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
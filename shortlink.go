@@ -1,6 +1,9 @@
 package main
 
 import (
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,12 +18,201 @@ type Shortlink struct {
 	AccessCount int                `json:"access_count" bson:"access_count"`
 	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
 	UpdatedAt   time.Time          `json:"updated_at" bson:"updated_at"`
+	// Additional shorts redirecting to the shortlink, unique across all shorts and aliases
+	Aliases []string `json:"aliases,omitempty" bson:"aliases"`
+	// Append the path and query following the short to the redirect URL
+	Forward bool `json:"forward" bson:"forward"`
+	// HTTP status code of the redirect, one of RedirectTypes or 0 to use the configured default
+	RedirectType int `json:"redirect_type" bson:"redirect_type"`
+	// Disabled shortlinks don't redirect
+	Disabled bool `json:"disabled" bson:"disabled"`
+	// Time from which on the shortlink redirects, immediately if nil
+	ActiveFrom *time.Time `json:"active_from,omitempty" bson:"active_from"`
+	// Time after which the shortlink no longer redirects, never if nil
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at"`
+	// Number of redirects after which the shortlink no longer redirects, unlimited if 0
+	MaxClicks int `json:"max_clicks" bson:"max_clicks"`
+	// Time the shortlink was moved to the trash, only set for deleted shortlinks
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	// Host of LongUrl, stored to filter shortlinks by their target domain
+	Host string `json:"-" bson:"host"`
+	// Lower case ShortUrl, stored to search shorts regardless of case via an index in MongoDB
+	ShortLower string `json:"-" bson:"short_lower"`
+	// ShortUrl and Aliases, stored to enforce their uniqueness via an index in MongoDB
+	Shorts []string `json:"-" bson:"shorts"`
+	// Normalized Shorts, stored to resolve shorts regardless of case and separators in MongoDB
+	Keys []string `json:"-" bson:"keys"`
 }
 
 // Shortlink Update struct
 type ShortlinkUpdate struct {
-	ShortUrl    string    `json:"short" bson:"short"`
-	LongUrl     string    `json:"long" bson:"long"`
-	Description string    `json:"descr" bson:"descr"`
-	UpdatedAt   time.Time `json:"updated_at" bson:"updated_at"`
+	ShortUrl     string     `json:"short" bson:"short"`
+	LongUrl      string     `json:"long" bson:"long"`
+	Description  string     `json:"descr" bson:"descr"`
+	Aliases      []string   `json:"aliases,omitempty" bson:"aliases"`
+	UpdatedAt    time.Time  `json:"updated_at" bson:"updated_at"`
+	Forward      bool       `json:"forward" bson:"forward"`
+	RedirectType int        `json:"redirect_type" bson:"redirect_type"`
+	Disabled     bool       `json:"disabled" bson:"disabled"`
+	ActiveFrom   *time.Time `json:"active_from,omitempty" bson:"active_from"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty" bson:"expires_at"`
+	MaxClicks    int        `json:"max_clicks" bson:"max_clicks"`
+	Host         string     `json:"-" bson:"host"`
+	ShortLower   string     `json:"-" bson:"short_lower"`
+	Shorts       []string   `json:"-" bson:"shorts"`
+	Keys         []string   `json:"-" bson:"keys"`
+}
+
+// allShorts returns the short and the aliases of a shortlink
+func allShorts(short string, aliases []string) []string {
+	return append([]string{short}, aliases...)
+}
+
+// normalizeShort returns the key of a short used to resolve it if shorts are normalized,
+// shorts differing only in case or using `_` instead of `-` have the same key
+func normalizeShort(short string) string {
+	return strings.ToLower(strings.ReplaceAll(short, "_", "-"))
+}
+
+// normalizeShorts returns the keys of the shorts
+func normalizeShorts(shorts []string) []string {
+	keys := make([]string, len(shorts))
+	for i, short := range shorts {
+		keys[i] = normalizeShort(short)
+	}
+	return keys
+}
+
+// States of a shortlink returned by the API
+const (
+	// The shortlink redirects
+	StateActive = "active"
+	// The shortlink doesn't redirect yet, see ActiveFrom
+	StateScheduled = "scheduled"
+	// The shortlink no longer redirects, see ExpiresAt and MaxClicks
+	StateExpired = "expired"
+	// The shortlink was disabled and doesn't redirect
+	StateDisabled = "disabled"
+	// The shortlink was moved to the trash
+	StateDeleted = "deleted"
+)
+
+// States shortlinks can be filtered by
+var States = []string{StateActive, StateScheduled, StateExpired, StateDisabled}
+
+// state returns the state of the shortlink at time `now`
+func (l *Shortlink) state(now time.Time) string {
+	switch {
+	case l.DeletedAt != nil:
+		return StateDeleted
+	case l.Disabled:
+		return StateDisabled
+	case l.scheduled(now):
+		return StateScheduled
+	case l.expired(now):
+		return StateExpired
+	}
+	return StateActive
+}
+
+// redirectError returns ErrNotFound, ErrDisabled, ErrScheduled or ErrExpired if the shortlink doesn't redirect
+// at time `now`, nil otherwise
+func (l *Shortlink) redirectError(now time.Time) error {
+	switch l.state(now) {
+	case StateDeleted:
+		return ErrNotFound
+	case StateDisabled:
+		return ErrDisabled
+	case StateScheduled:
+		return ErrScheduled
+	case StateExpired:
+		return ErrExpired
+	}
+	return nil
+}
+
+// scheduled returns true if the shortlink isn't active yet at time `now`
+func (l *Shortlink) scheduled(now time.Time) bool {
+	return l.ActiveFrom != nil && l.ActiveFrom.After(now)
+}
+
+// expired returns true if the shortlink expired or reached its maximum number of clicks at time `now`
+func (l *Shortlink) expired(now time.Time) bool {
+	if l.ExpiresAt != nil && !l.ExpiresAt.After(now) {
+		return true
+	}
+	return l.MaxClicks > 0 && l.AccessCount >= l.MaxClicks
+}
+
+// HTTP status codes supported as redirect type
+var RedirectTypes = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// isRedirectType returns true if `code` is one of RedirectTypes
+func isRedirectType(code int) bool {
+	for _, t := range RedirectTypes {
+		if code == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Response struct for shortlinks returned by the API
+type ShortlinkResponse struct {
+	*Shortlink
+	// Absolute URL of the redirect under /go/
+	Redirect string `json:"redirect"`
+	// Current state of the shortlink, one of the State constants
+	State string `json:"state"`
+}
+
+// Response struct for a page of shortlinks
+type ShortlinkPage struct {
+	Shortlinks []*ShortlinkResponse `json:"shortlinks"`
+	// Total number of shortlinks matching the query
+	Total int64 `json:"total"`
+	// Token to request the next page, empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// linkHost returns the lower case host name of an URL without port,
+// the empty string if the URL can't be parsed
+func linkHost(long string) string {
+	u, err := url.Parse(long)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// forwardURL appends the escaped path `rest` and the query `query` of a redirect request to the URL `long`.
+// The path is joined with a single slash, query parameters of the request replace those of `long`.
+func forwardURL(long string, rest string, query url.Values) (string, error) {
+	u, err := url.Parse(long)
+	if err != nil {
+		return "", err
+	}
+
+	if rest != "" {
+		path := strings.TrimSuffix(u.EscapedPath(), "/") + "/" + strings.TrimLeft(rest, "/")
+		if u.Path, err = url.PathUnescape(path); err != nil {
+			return "", err
+		}
+		u.RawPath = path
+	}
+
+	if len(query) > 0 {
+		merged := u.Query()
+		for key, values := range query {
+			merged[key] = values
+		}
+		u.RawQuery = merged.Encode()
+	}
+	return u.String(), nil
 }
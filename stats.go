@@ -0,0 +1,329 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ClickRollup aggregates the click events of a shortlink within an hour
+type ClickRollup struct {
+	ShortlinkID primitive.ObjectID
+	// Start of the hour
+	Hour   time.Time
+	Clicks int64
+	// Estimates the number of distinct clients
+	Visitors visitorSketch
+	// Clicks by the host of their referrer, without clicks lacking a referrer
+	Referrers map[string]int64
+	// Clicks by the userAgentFamily of their user agent
+	Agents map[string]int64
+}
+
+// Kinds of counters of a ClickRollup by name
+const (
+	countReferrer = "referrer"
+	countAgent    = "agent"
+)
+
+// rollUp aggregates the click events by their shortlink and hour
+func rollUp(events []*ClickEvent) []*ClickRollup {
+	type key struct {
+		id   primitive.ObjectID
+		hour time.Time
+	}
+	rollups := []*ClickRollup{}
+	byKey := map[key]*ClickRollup{}
+	for _, event := range events {
+		hour := event.ClickedAt.UTC().Truncate(time.Hour)
+		rollup, ok := byKey[key{event.ShortlinkID, hour}]
+		if !ok {
+			rollup = &ClickRollup{
+				ShortlinkID: event.ShortlinkID,
+				Hour:        hour,
+				Visitors:    newVisitorSketch(),
+				Referrers:   map[string]int64{},
+				Agents:      map[string]int64{},
+			}
+			byKey[key{event.ShortlinkID, hour}] = rollup
+			rollups = append(rollups, rollup)
+		}
+		rollup.Clicks++
+		rollup.Visitors.add(event.ClientHash)
+		if host := referrerHost(event.Referrer); host != "" {
+			rollup.Referrers[host]++
+		}
+		rollup.Agents[userAgentFamily(event.UserAgent)]++
+	}
+	return rollups
+}
+
+// merge adds the clicks of `other` to the rollup
+func (r *ClickRollup) merge(other *ClickRollup) {
+	r.Clicks += other.Clicks
+	r.Visitors = r.Visitors.merge(other.Visitors)
+	for name, clicks := range other.Referrers {
+		r.Referrers[name] += clicks
+	}
+	for name, clicks := range other.Agents {
+		r.Agents[name] += clicks
+	}
+}
+
+// referrerHost returns the lower case host of the referrer URL, empty if there is none
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Families of user agents identified by a substring, checked in order
+// as user agents commonly mention the browsers they are derived from
+var userAgentFamilies = []struct{ family, substring string }{
+	{"Bot", "bot"},
+	{"Bot", "spider"},
+	{"Bot", "crawl"},
+	{"curl", "curl/"},
+	{"Wget", "wget/"},
+	{"Edge", "edg/"},
+	{"Edge", "edge/"},
+	{"Opera", "opr/"},
+	{"Samsung Internet", "samsungbrowser/"},
+	{"Chrome", "crios/"},
+	{"Chrome", "chrome/"},
+	{"Firefox", "fxios/"},
+	{"Firefox", "firefox/"},
+	{"Safari", "safari/"},
+	{"Internet Explorer", "trident/"},
+	{"Internet Explorer", "msie "},
+}
+
+// userAgentFamily returns the family of browsers or clients the user agent belongs to
+func userAgentFamily(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown"
+	}
+	ua := strings.ToLower(userAgent)
+	for _, f := range userAgentFamilies {
+		if strings.Contains(ua, f.substring) {
+			return f.family
+		}
+	}
+	return "Other"
+}
+
+/* ****************************************** *\
+ * ************ VISITOR SKETCHES ************ *
+\* ****************************************** */
+
+// Number of bits of a hash selecting a register of a visitorSketch
+const sketchPrecision = 10
+
+// Number of registers of a visitorSketch, the standard error of its estimates is 1.04/sqrt(sketchRegisters)
+const sketchRegisters = 1 << sketchPrecision
+
+// visitorSketch is a HyperLogLog sketch estimating the number of distinct clients by their hashes
+// in constant space, sketches of different hours are merged to estimate the clients of a longer period
+type visitorSketch []byte
+
+// newVisitorSketch returns an empty sketch
+func newVisitorSketch() visitorSketch {
+	return make(visitorSketch, sketchRegisters)
+}
+
+// add counts the client with the hex encoded hash, clients without hash are ignored
+func (v visitorSketch) add(clientHash string) {
+	if len(clientHash) < 16 {
+		return
+	}
+	// The hash is uniformly distributed, its first 64 bits are sufficient
+	x, err := strconv.ParseUint(clientHash[:16], 16, 64)
+	if err != nil {
+		return
+	}
+	register := x >> (64 - sketchPrecision)
+	// Position of the first 1 bit of the remaining bits, guarded by the last bit
+	rank := byte(bits.LeadingZeros64(x<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > v[register] {
+		v[register] = rank
+	}
+}
+
+// merge returns a sketch counting the clients of both sketches, which may be empty or invalid
+func (v visitorSketch) merge(other visitorSketch) visitorSketch {
+	if len(v) != sketchRegisters {
+		v = newVisitorSketch()
+	}
+	if len(other) != sketchRegisters {
+		return v
+	}
+	for i, rank := range other {
+		if rank > v[i] {
+			v[i] = rank
+		}
+	}
+	return v
+}
+
+// estimate returns the estimated number of distinct clients
+func (v visitorSketch) estimate() int64 {
+	if len(v) != sketchRegisters {
+		return 0
+	}
+	m := float64(sketchRegisters)
+	sum, zeros := 0.0, 0
+	for _, rank := range v {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Count the empty registers instead for small numbers of clients
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+/* ****************************************** *\
+ * ************** STATISTICS **************** *
+\* ****************************************** */
+
+// Sizes of the buckets of click statistics
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+	BucketWeek = "week"
+)
+
+// Buckets lists the valid sizes of buckets
+var Buckets = []string{BucketHour, BucketDay, BucketWeek}
+
+// Maximum range of click statistics in hours, limiting the hourly rollups read regardless of the bucket size
+const maxStatsHours = 366 * 24
+
+// Number of top referrers and user agents in click statistics
+const topCount = 10
+
+// ClickStats are the click statistics of a shortlink over a range of time
+type ClickStats struct {
+	Short string `json:"short"`
+	// Clicks since the shortlink was created, including those before click events were recorded
+	AccessCount int       `json:"access_count"`
+	Bucket      string    `json:"bucket"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	// Clicks in the range
+	Clicks int64 `json:"clicks"`
+	// Estimated number of distinct clients in the range
+	UniqueVisitors int64          `json:"unique_visitors"`
+	Series         []*ClickBucket `json:"series"`
+	TopReferrers   []*ClickCount  `json:"top_referrers"`
+	TopUserAgents  []*ClickCount  `json:"top_user_agents"`
+}
+
+// ClickBucket contains the clicks within a bucket of click statistics
+type ClickBucket struct {
+	Start          time.Time `json:"start"`
+	Clicks         int64     `json:"clicks"`
+	UniqueVisitors int64     `json:"unique_visitors"`
+}
+
+// ClickCount is the number of clicks with a referrer or user agent
+type ClickCount struct {
+	Name   string `json:"name"`
+	Clicks int64  `json:"clicks"`
+}
+
+// bucketStart returns the start of the bucket containing `t`, weeks start on Monday
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	switch bucket {
+	case BucketHour:
+		return t.Truncate(time.Hour)
+	case BucketWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// nextBucket returns the start of the bucket following the one starting at `start`
+func nextBucket(start time.Time, bucket string) time.Time {
+	switch bucket {
+	case BucketHour:
+		return start.Add(time.Hour)
+	case BucketWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// clickStats aggregates the hourly rollups of the shortlink into buckets between `from` and `to`,
+// `from` is aligned to the start of its bucket
+func clickStats(shortlink *Shortlink, rollups []*ClickRollup, from, to time.Time, bucket string) *ClickStats {
+	from = bucketStart(from, bucket)
+	stats := &ClickStats{
+		Short:         shortlink.ShortUrl,
+		AccessCount:   shortlink.AccessCount,
+		Bucket:        bucket,
+		From:          from,
+		To:            to,
+		Series:        []*ClickBucket{},
+		TopReferrers:  []*ClickCount{},
+		TopUserAgents: []*ClickCount{},
+	}
+
+	total := &ClickRollup{Referrers: map[string]int64{}, Agents: map[string]int64{}}
+	i := 0
+	for start := from; start.Before(to); start = nextBucket(start, bucket) {
+		end := nextBucket(start, bucket)
+		sum := &ClickRollup{Referrers: map[string]int64{}, Agents: map[string]int64{}}
+		for ; i < len(rollups) && rollups[i].Hour.Before(end); i++ {
+			if !rollups[i].Hour.Before(start) {
+				sum.merge(rollups[i])
+			}
+		}
+		stats.Series = append(stats.Series, &ClickBucket{
+			Start:          start,
+			Clicks:         sum.Clicks,
+			UniqueVisitors: sum.Visitors.estimate(),
+		})
+		total.merge(sum)
+	}
+
+	stats.Clicks = total.Clicks
+	stats.UniqueVisitors = total.Visitors.estimate()
+	stats.TopReferrers = topCounts(total.Referrers, topCount)
+	stats.TopUserAgents = topCounts(total.Agents, topCount)
+	return stats
+}
+
+// topCounts returns the `n` names with the most clicks, ordered by clicks and name
+func topCounts(clicks map[string]int64, n int) []*ClickCount {
+	counts := make([]*ClickCount, 0, len(clicks))
+	for name, c := range clicks {
+		counts = append(counts, &ClickCount{Name: name, Clicks: c})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Clicks != counts[j].Clicks {
+			return counts[i].Clicks > counts[j].Clicks
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Store is the storage backend for shortlinks.
+// Implementations must be safe to be used by multiple goroutines.
+type Store interface {
+	EventStore
+	// ListShortlinks retrives the shortlinks matching the query and the total number of matching shortlinks
+	ListShortlinks(query *ListQuery) ([]*Shortlink, int64, error)
+	// GetAllShorts retrives the shorts and aliases of all shortlinks
+	GetAllShorts() ([]string, error)
+	// GetShortlinkByShort retrives a shortlink by its short or one of its aliases, resolved by SetNormalizeShorts,
+	// returns ErrNotFound if it doesn't exist
+	GetShortlinkByShort(short string) (*Shortlink, error)
+	// Create a new shortlink, sets its ID and timestamps,
+	// returns ErrDuplicate if the short or one of the aliases is already taken
+	Create(shortlink *Shortlink) error
+	// Update an existing shortlink with the primary short `short` with new data `shortlink`,
+	// neither aliases nor normalized shorts are resolved,
+	// returns ErrNotFound if it doesn't exist and ErrDuplicate if the new short is taken
+	Update(short string, shortlink *ShortlinkUpdate) (*Shortlink, error)
+	// Delete moves an existing shortlink with the primary short `short` to the trash,
+	// neither aliases nor normalized shorts are resolved,
+	// returns the number of deleted shortlinks (0 or 1)
+	Delete(short string) (int64, error)
+	// ListTrash returns up to `limit` (all if 0) deleted shortlinks after skipping `offset`,
+	// most recently deleted first, and the total number of deleted shortlinks
+	ListTrash(offset int, limit int) ([]*Shortlink, int64, error)
+	// IsTrashed returns true if there is a deleted shortlink with the given short
+	IsTrashed(short string) (bool, error)
+	// Restore moves the most recently deleted shortlink `short` back from the trash and sets its update time,
+	// returns ErrNotFound if there is none and ErrDuplicate if the short is taken
+	Restore(short string) (*Shortlink, error)
+	// PurgeTrash permanently deletes the shortlinks deleted before `before`, returns their number
+	PurgeTrash(before time.Time) (int64, error)
+	// AddRevision records a revision of the shortlink `revision.ShortlinkID`, sets its number and time
+	AddRevision(revision *Revision) error
+	// ListRevisions returns the revisions of the shortlink with the ID, oldest first
+	ListRevisions(id primitive.ObjectID) ([]*Revision, error)
+	// GetRedirect retrives a shortlink to redirect to by its short or one of its aliases, resolved as by GetShortlinkByShort,
+	// and increments its access count,
+	// returns ErrNotFound if it doesn't exist and without incrementing ErrDisabled if it is disabled,
+	// ErrScheduled if it isn't active yet or ErrExpired if it expired or its access count reached its maximum number of clicks
+	GetRedirect(short string) (*Shortlink, error)
+	// IncrementAccessCounts adds the counts to the access counts of the shortlinks with the IDs,
+	// shortlinks that don't exist anymore are skipped
+	IncrementAccessCounts(counts map[primitive.ObjectID]int) error
+	// IsFree returns true if there is no shortlink with the given short or alias, resolved as by GetShortlinkByShort
+	IsFree(short string) (bool, error)
+	// Search returns up to `limit` shortlinks matching the query ranked by rankSearchResults
+	Search(query string, limit int) ([]*Shortlink, error)
+	// SetNormalizeShorts enables or disables resolving shorts and aliases by their normalizeShort keys,
+	// which are unique while enabled. Returns ErrDuplicate if existing shorts have the same key.
+	// Must be called before the store is used by multiple goroutines.
+	SetNormalizeShorts(enabled bool) error
+	// PurgeExpired deletes shortlinks that expired or reached their maximum number of clicks,
+	// returns the number of deleted shortlinks
+	PurgeExpired() (int64, error)
+	// Close releases all resources held by the store
+	Close() error
+}
+
+// EventStore stores the click events of shortlinks separately from the shortlinks
+type EventStore interface {
+	// AddEvents records the click events and adds them to the hourly ClickRollups of their shortlinks
+	AddEvents(events []*ClickEvent) error
+	// ListEvents returns up to `limit` click events of the shortlink with the ID, most recent first
+	ListEvents(id primitive.ObjectID, limit int) ([]*ClickEvent, error)
+	// PurgeEvents deletes the click events recorded before `before`, returns their number,
+	// their ClickRollups are kept
+	PurgeEvents(before time.Time) (int64, error)
+	// ClickRollups returns the hourly rollups of the click events of the shortlink with the ID
+	// from `from` until before `to`, oldest first
+	ClickRollups(id primitive.ObjectID, from time.Time, to time.Time) ([]*ClickRollup, error)
+}
+
+// ChangeWatcher is implemented by stores shared by multiple instances of the service
+// to report the shortlinks changed by any of them, so they can be evicted from the redirect cache
+type ChangeWatcher interface {
+	// WatchChanges calls `changed` for the shortlinks created, updated or deleted until the context is done
+	// or watching fails, resuming after the last change reported to the watcher `name` if possible.
+	// Returns ErrWatchUnsupported if changes can only be polled.
+	WatchChanges(ctx context.Context, name string, changed func(*ShortlinkChange)) error
+	// PollChanges returns the shortlinks created, updated or deleted since `since`
+	// and the time to poll from next
+	PollChanges(since time.Time) ([]*ShortlinkChange, time.Time, error)
+}
+
+// ShortlinkChange identifies a shortlink changed in a ChangeWatcher
+type ShortlinkChange struct {
+	ID primitive.ObjectID
+	// Short and aliases after the change, empty if the shortlink was deleted
+	Shorts []string
+	// Set if any shortlink may have changed, e.g. because changes were missed
+	All bool
+}
+
+// ListQuery filters, sorts and paginates the shortlinks returned by ListShortlinks
+type ListQuery struct {
+	// Only shortlinks whose short starts with Prefix, if set
+	Prefix string
+	// Only shortlinks whose target URL has this host, if set
+	Host string
+	// Only shortlinks created after CreatedAfter, if set
+	CreatedAfter time.Time
+	// Only shortlinks created before CreatedBefore, if set
+	CreatedBefore time.Time
+	// Only shortlinks currently in this state, one of States, if set
+	State string
+	// Sort by this field, one of the SortFields, defaults to `created_at`
+	SortBy string
+	// Sort in descending order
+	Descending bool
+	// Number of shortlinks to skip
+	Offset int
+	// Maximum number of shortlinks to return, 0 for all
+	Limit int
+}
+
+// Fields shortlinks can be sorted by
+var SortFields = []string{"short", "created_at", "updated_at", "access_count"}
+
+// ErrNotFound is returned by a Store if the requested shortlink doesn't exist
+var ErrNotFound = errors.New("shortlink not found")
+
+// ErrDuplicate is returned by a Store if a short is already taken
+var ErrDuplicate = errors.New("shortlink already exists")
+
+// ErrDisabled is returned by a Store if a shortlink is disabled
+var ErrDisabled = errors.New("shortlink disabled")
+
+// ErrScheduled is returned by a Store if a shortlink isn't active yet
+var ErrScheduled = errors.New("shortlink not active yet")
+
+// ErrExpired is returned by a Store if a shortlink expired or reached its maximum number of clicks
+var ErrExpired = errors.New("shortlink expired")
+
+// ErrWatchUnsupported is returned by a ChangeWatcher if it can't watch changes as they happen
+var ErrWatchUnsupported = errors.New("watching changes not supported")
+
+/* ****************************************** *\
+ * ************ HELPER FUNCTIONS ************ *
+\* ****************************************** */
+
+// Number of attempts to record a revision numbered concurrently by another request
+const revisionAttempts = 3
+
+// Timeout for database operations
+var timeout = 5
+
+// TimedContext returns a timed context using the default timeout.
+func TimedContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+}
+
+// storeTime returns the current time in the precision stored by MongoDB
+func storeTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// storeTimePtr returns a copy of `t` in the precision stored by MongoDB, nil if `t` is nil
+func storeTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	stored := t.UTC().Truncate(time.Millisecond)
+	return &stored
+}
+
+// Unbound context for long operations
+func UnboundContext() context.Context {
+	return context.Background()
+}
+
+// Check if is a not found error
+func isNotFundError(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// Check if is duplicate error
+func isDuplicateError(err error) bool {
+	return errors.Is(err, ErrDuplicate)
+}
+
+// Check if is disabled error
+func isDisabledError(err error) bool {
+	return errors.Is(err, ErrDisabled)
+}
+
+// Check if is scheduled error
+func isScheduledError(err error) bool {
+	return errors.Is(err, ErrScheduled)
+}
+
+// Check if is expired error
+func isExpiredError(err error) bool {
+	return errors.Is(err, ErrExpired)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is a Store keeping all shortlinks in memory.
+// It mirrors the semantics of the MongoStore and is mainly used for testing.
+type MemoryStore struct {
+	// Guards all fields
+	mu sync.RWMutex
+	// Shortlinks by their short
+	links map[string]*Shortlink
+	// Shorts of shortlinks by their aliases
+	aliases map[string]string
+	// Shorts of shortlinks by the normalized keys of their shorts and aliases, nil unless shorts are normalized
+	keys map[string]string
+	// Deleted shortlinks in the order of their deletion
+	trash []*Shortlink
+	// Revisions by the ID of their shortlink, oldest first
+	revisions map[primitive.ObjectID][]*Revision
+	// Click events in the order they were added
+	events []*ClickEvent
+	// Hourly rollups of click events by their shortlink and hour
+	rollups map[primitive.ObjectID]map[time.Time]*ClickRollup
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		links:     map[string]*Shortlink{},
+		aliases:   map[string]string{},
+		revisions: map[primitive.ObjectID][]*Revision{},
+		rollups:   map[primitive.ObjectID]map[time.Time]*ClickRollup{},
+	}
+}
+
+// Close does nothing for the MemoryStore
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// ListShortlinks returns the shortlinks matching the query
+func (s *MemoryStore) ListShortlinks(query *ListQuery) ([]*Shortlink, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := storeTime()
+	shortlinks := make([]*Shortlink, 0, len(s.links))
+	for _, link := range s.links {
+		if query.matches(link, now) {
+			result := *link
+			shortlinks = append(shortlinks, &result)
+		}
+	}
+	sort.Slice(shortlinks, func(i, j int) bool {
+		return query.less(shortlinks[i], shortlinks[j])
+	})
+
+	total := int64(len(shortlinks))
+	return query.page(shortlinks), total, nil
+}
+
+// GetAllShorts returns the shorts and aliases of all shortlinks
+func (s *MemoryStore) GetAllShorts() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shorts := make([]string, 0, len(s.links)+len(s.aliases))
+	for short := range s.links {
+		shorts = append(shorts, short)
+	}
+	for alias := range s.aliases {
+		shorts = append(shorts, alias)
+	}
+	sort.Strings(shorts)
+	return shorts, nil
+}
+
+// GetShortlinkByShort returns a copy of the shortlink with the given short or alias
+func (s *MemoryStore) GetShortlinkByShort(short string) (*Shortlink, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	link := s.resolve(short)
+	if link == nil {
+		return nil, ErrNotFound
+	}
+	result := *link
+	return &result, nil
+}
+
+// Create stores a copy of the shortlink
+func (s *MemoryStore) Create(shortlink *Shortlink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.free(allShorts(shortlink.ShortUrl, shortlink.Aliases), nil) {
+		return ErrDuplicate
+	}
+
+	shortlink.ID = primitive.NewObjectID()
+	shortlink.CreatedAt = storeTime()
+	shortlink.UpdatedAt = shortlink.CreatedAt
+	shortlink.Host = linkHost(shortlink.LongUrl)
+	shortlink.ActiveFrom = storeTimePtr(shortlink.ActiveFrom)
+	shortlink.ExpiresAt = storeTimePtr(shortlink.ExpiresAt)
+
+	stored := *shortlink
+	s.add(&stored)
+	return nil
+}
+
+// Update an existing shortlink `short` with new data `shortlink`
+func (s *MemoryStore) Update(short string, shortlink *ShortlinkUpdate) (*Shortlink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[short]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !s.free(allShorts(shortlink.ShortUrl, shortlink.Aliases), link) {
+		return nil, ErrDuplicate
+	}
+
+	shortlink.UpdatedAt = storeTime()
+	shortlink.Host = linkHost(shortlink.LongUrl)
+	shortlink.ActiveFrom = storeTimePtr(shortlink.ActiveFrom)
+	shortlink.ExpiresAt = storeTimePtr(shortlink.ExpiresAt)
+	link.ShortUrl = shortlink.ShortUrl
+	link.LongUrl = shortlink.LongUrl
+	link.Description = shortlink.Description
+	link.Aliases = shortlink.Aliases
+	link.UpdatedAt = shortlink.UpdatedAt
+	link.Forward = shortlink.Forward
+	link.RedirectType = shortlink.RedirectType
+	link.Disabled = shortlink.Disabled
+	link.ActiveFrom = shortlink.ActiveFrom
+	link.ExpiresAt = shortlink.ExpiresAt
+	link.MaxClicks = shortlink.MaxClicks
+	link.Host = shortlink.Host
+
+	s.remove(link)
+	s.add(link)
+
+	result := *link
+	return &result, nil
+}
+
+// Delete an existing shortlink
+func (s *MemoryStore) Delete(short string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[short]
+	if !ok {
+		return 0, nil
+	}
+	s.remove(link)
+	deletedAt := storeTime()
+	link.DeletedAt = &deletedAt
+	s.trash = append(s.trash, link)
+	return 1, nil
+}
+
+// ListTrash returns copies of the deleted shortlinks, most recently deleted first
+func (s *MemoryStore) ListTrash(offset int, limit int) ([]*Shortlink, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trash := make([]*Shortlink, 0, len(s.trash))
+	for i := len(s.trash) - 1; i >= 0; i-- {
+		result := *s.trash[i]
+		trash = append(trash, &result)
+	}
+	page := &ListQuery{Offset: offset, Limit: limit}
+	return page.page(trash), int64(len(trash)), nil
+}
+
+// IsTrashed returns true if there is a deleted shortlink with the given short
+func (s *MemoryStore) IsTrashed(short string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, link := range s.trash {
+		if link.ShortUrl == short {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Restore moves the most recently deleted shortlink `short` back from the trash and sets its update time
+func (s *MemoryStore) Restore(short string) (*Shortlink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.trash) - 1; i >= 0; i-- {
+		link := s.trash[i]
+		if link.ShortUrl != short {
+			continue
+		}
+		if !s.free(allShorts(link.ShortUrl, link.Aliases), nil) {
+			return nil, ErrDuplicate
+		}
+		s.trash = append(s.trash[:i], s.trash[i+1:]...)
+		link.DeletedAt = nil
+		link.UpdatedAt = storeTime()
+		s.add(link)
+		result := *link
+		return &result, nil
+	}
+	return nil, ErrNotFound
+}
+
+// PurgeTrash permanently deletes the shortlinks deleted before `before`
+func (s *MemoryStore) PurgeTrash(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.trash[:0]
+	for _, link := range s.trash {
+		if !link.DeletedAt.Before(before) {
+			kept = append(kept, link)
+		}
+	}
+	deleted := int64(len(s.trash) - len(kept))
+	s.trash = kept
+	return deleted, nil
+}
+
+// AddRevision stores a copy of the revision numbered after the previous revisions of its shortlink
+func (s *MemoryStore) AddRevision(revision *Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revisions := s.revisions[revision.ShortlinkID]
+	revision.Rev = len(revisions) + 1
+	revision.CreatedAt = storeTime()
+	revision.Shortlink.ActiveFrom = storeTimePtr(revision.Shortlink.ActiveFrom)
+	revision.Shortlink.ExpiresAt = storeTimePtr(revision.Shortlink.ExpiresAt)
+
+	stored := *revision
+	s.revisions[revision.ShortlinkID] = append(revisions, &stored)
+	return nil
+}
+
+// ListRevisions returns copies of the revisions of the shortlink with the ID, oldest first
+func (s *MemoryStore) ListRevisions(id primitive.ObjectID) ([]*Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revisions := make([]*Revision, len(s.revisions[id]))
+	for i, revision := range s.revisions[id] {
+		result := *revision
+		revisions[i] = &result
+	}
+	return revisions, nil
+}
+
+// AddEvents stores copies of the click events
+func (s *MemoryStore) AddEvents(events []*ClickEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range events {
+		stored := *event
+		stored.ClickedAt = stored.ClickedAt.UTC().Truncate(time.Millisecond)
+		s.events = append(s.events, &stored)
+	}
+	for _, rollup := range rollUp(events) {
+		hours, ok := s.rollups[rollup.ShortlinkID]
+		if !ok {
+			hours = map[time.Time]*ClickRollup{}
+			s.rollups[rollup.ShortlinkID] = hours
+		}
+		if stored, ok := hours[rollup.Hour]; ok {
+			stored.merge(rollup)
+		} else {
+			hours[rollup.Hour] = rollup
+		}
+	}
+	return nil
+}
+
+// ListEvents returns copies of the most recent click events of the shortlink with the ID
+func (s *MemoryStore) ListEvents(id primitive.ObjectID, limit int) ([]*ClickEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []*ClickEvent{}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if s.events[i].ShortlinkID == id {
+			result := *s.events[i]
+			events = append(events, &result)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ClickedAt.After(events[j].ClickedAt)
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// PurgeEvents deletes the click events recorded before `before`
+func (s *MemoryStore) PurgeEvents(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if !event.ClickedAt.Before(before) {
+			kept = append(kept, event)
+		}
+	}
+	deleted := int64(len(s.events) - len(kept))
+	s.events = kept
+	return deleted, nil
+}
+
+// ClickRollups returns copies of the hourly rollups of the shortlink between `from` and `to`
+func (s *MemoryStore) ClickRollups(id primitive.ObjectID, from time.Time, to time.Time) ([]*ClickRollup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rollups := []*ClickRollup{}
+	for hour, rollup := range s.rollups[id] {
+		if hour.Before(from) || !hour.Before(to) {
+			continue
+		}
+		result := &ClickRollup{ShortlinkID: id, Hour: hour, Referrers: map[string]int64{}, Agents: map[string]int64{}}
+		result.merge(rollup)
+		rollups = append(rollups, result)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		return rollups[i].Hour.Before(rollups[j].Hour)
+	})
+	return rollups, nil
+}
+
+// GetRedirect increments the access count of a shortlink if it is active and returns a copy of it
+func (s *MemoryStore) GetRedirect(short string) (*Shortlink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link := s.resolve(short)
+	if link == nil {
+		return nil, ErrNotFound
+	}
+	if err := link.redirectError(storeTime()); err != nil {
+		return nil, err
+	}
+	link.AccessCount++
+	result := *link
+	return &result, nil
+}
+
+// IncrementAccessCounts adds the counts to the access counts of the shortlinks with the IDs
+func (s *MemoryStore) IncrementAccessCounts(counts map[primitive.ObjectID]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, link := range s.links {
+		link.AccessCount += counts[link.ID]
+	}
+	return nil
+}
+
+// IsFree returns true if there is no shortlink with the given short or alias
+func (s *MemoryStore) IsFree(short string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.resolve(short) == nil, nil
+}
+
+// Search ranks all shortlinks by their relevance for the query
+func (s *MemoryStore) Search(query string, limit int) ([]*Shortlink, error) {
+	all, _, err := s.ListShortlinks(&ListQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return rankSearchResults(query, all, limit), nil
+}
+
+// PurgeExpired deletes the shortlinks that expired or reached their maximum number of clicks
+func (s *MemoryStore) PurgeExpired() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := storeTime()
+	var deleted int64
+	for _, link := range s.links {
+		if link.expired(now) {
+			s.remove(link)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// SetNormalizeShorts enables or disables resolving shorts by their normalized keys
+func (s *MemoryStore) SetNormalizeShorts(enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !enabled {
+		s.keys = nil
+		return nil
+	}
+	keys := map[string]string{}
+	for short, link := range s.links {
+		for _, key := range normalizeShorts(allShorts(short, link.Aliases)) {
+			if _, ok := keys[key]; ok {
+				return ErrDuplicate
+			}
+			keys[key] = short
+		}
+	}
+	s.keys = keys
+	return nil
+}
+
+// resolve returns the shortlink with the given short or alias, nil if there is none
+func (s *MemoryStore) resolve(short string) *Shortlink {
+	if s.keys != nil {
+		return s.links[s.keys[normalizeShort(short)]]
+	}
+	if link, ok := s.links[short]; ok {
+		return link
+	}
+	return s.links[s.aliases[short]]
+}
+
+// free returns true if none of the shorts is used by another shortlink than `except`
+func (s *MemoryStore) free(shorts []string, except *Shortlink) bool {
+	for _, short := range shorts {
+		if link := s.resolve(short); link != nil && link != except {
+			return false
+		}
+	}
+	return true
+}
+
+// add indexes the shortlink by its short and aliases
+func (s *MemoryStore) add(link *Shortlink) {
+	s.links[link.ShortUrl] = link
+	for _, alias := range link.Aliases {
+		s.aliases[alias] = link.ShortUrl
+	}
+	if s.keys != nil {
+		for _, key := range normalizeShorts(allShorts(link.ShortUrl, link.Aliases)) {
+			s.keys[key] = link.ShortUrl
+		}
+	}
+}
+
+// remove removes the shortlink indexed by add, even if its short and aliases changed since
+func (s *MemoryStore) remove(link *Shortlink) {
+	for alias, short := range s.aliases {
+		if s.links[short] == link {
+			delete(s.aliases, alias)
+		}
+	}
+	for key, short := range s.keys {
+		if s.links[short] == link {
+			delete(s.keys, key)
+		}
+	}
+	for short, other := range s.links {
+		if other == link {
+			delete(s.links, short)
+		}
+	}
+}
+
+// matches returns true if the shortlink matches the filters of the query at time `now`
+func (q *ListQuery) matches(link *Shortlink, now time.Time) bool {
+	return strings.HasPrefix(link.ShortUrl, q.Prefix) &&
+		(q.Host == "" || link.Host == strings.ToLower(q.Host)) &&
+		(q.CreatedAfter.IsZero() || link.CreatedAt.After(q.CreatedAfter)) &&
+		(q.CreatedBefore.IsZero() || link.CreatedAt.Before(q.CreatedBefore)) &&
+		(q.State == "" || link.state(now) == q.State)
+}
+
+// less compares two shortlinks by the sort field of the query and their ID
+func (q *ListQuery) less(a, b *Shortlink) bool {
+	var cmp int
+	switch q.SortBy {
+	case "short":
+		cmp = strings.Compare(a.ShortUrl, b.ShortUrl)
+	case "updated_at":
+		cmp = compareTime(a.UpdatedAt, b.UpdatedAt)
+	case "access_count":
+		cmp = a.AccessCount - b.AccessCount
+	default:
+		cmp = compareTime(a.CreatedAt, b.CreatedAt)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID.Hex(), b.ID.Hex())
+	}
+	if q.Descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// page returns the page of the sorted shortlinks selected by the query
+func (q *ListQuery) page(shortlinks []*Shortlink) []*Shortlink {
+	if q.Offset >= len(shortlinks) {
+		return []*Shortlink{}
+	}
+	shortlinks = shortlinks[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(shortlinks) {
+		shortlinks = shortlinks[:q.Limit]
+	}
+	return shortlinks
+}
+
+// compareTime returns -1, 0 or 1 if t1 is before, equal or after t2
+func compareTime(t1, t2 time.Time) int {
+	switch {
+	case t1.Before(t2):
+		return -1
+	case t1.After(t2):
+		return 1
+	}
+	return 0
+}
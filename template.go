@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Placeholders of template links, numbered like {1} or named like {ticket}
+var placeholderPattern = regexp.MustCompile(`\{([1-9][0-9]?|[a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// templateParams returns the names of the path segments filling the placeholders of the template link `long`,
+// nil if it contains no placeholders.
+// A numbered placeholder {n} is filled by the n-th segment, a named placeholder by the segment
+// at its position among the distinct placeholders, e.g. {ticket} in .../{project}/{ticket} by the second.
+func templateParams(long string) []string {
+	var params []string
+	seen := map[string]bool{}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(long, -1) {
+		name := match[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		position := len(seen)
+		if n, err := strconv.Atoi(name); err == nil {
+			position = n
+		}
+		for len(params) < position {
+			params = append(params, "")
+		}
+		if params[position-1] == "" {
+			params[position-1] = name
+		}
+	}
+	// Segments not used by any placeholder are still required to fill those following them
+	for i, name := range params {
+		if name == "" {
+			params[i] = strconv.Itoa(i + 1)
+		}
+	}
+	return params
+}
+
+// templateUsage returns how to call the template link `short`, e.g. go/jira/{ticket}
+func templateUsage(short string, params []string) string {
+	usage := "go/" + short
+	for _, name := range params {
+		usage += "/{" + name + "}"
+	}
+	return usage
+}
+
+// expandTemplate fills the placeholders of the template link `long` with the unescaped path segments `args`,
+// which must contain at least one argument per parameter returned by templateParams.
+// Arguments are escaped for their position in the URL, i.e. in the query or elsewhere.
+func expandTemplate(long string, args []string) string {
+	values := map[string]string{}
+	for i, name := range templateParams(long) {
+		values[name] = args[i]
+		values[strconv.Itoa(i+1)] = args[i]
+	}
+
+	queryStart := strings.Index(long, "?")
+	queryEnd := strings.Index(long, "#")
+	if queryEnd < 0 {
+		queryEnd = len(long)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(long, -1) {
+		b.WriteString(long[last:match[0]])
+		value := values[long[match[2]:match[3]]]
+		if queryStart >= 0 && match[0] > queryStart && match[0] < queryEnd {
+			b.WriteString(url.QueryEscape(value))
+		} else {
+			b.WriteString(url.PathEscape(value))
+		}
+		last = match[1]
+	}
+	b.WriteString(long[last:])
+	return b.String()
+}
+
+// templateArgs takes up to `n` arguments from the non-empty segments of the escaped path `rest`
+// and returns them unescaped along with the remaining path
+func templateArgs(rest string, n int) ([]string, string) {
+	args := []string{}
+	for len(args) < n {
+		rest = strings.TrimLeft(rest, "/")
+		if rest == "" {
+			break
+		}
+		segment := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			segment = rest[:i]
+		}
+		rest = rest[len(segment):]
+		arg, err := url.PathUnescape(segment)
+		if err != nil {
+			arg = segment
+		}
+		args = append(args, arg)
+	}
+	return args, rest
+}
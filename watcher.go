@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// Ways to learn about shortlinks changed by other instances of the service
+const (
+	// Watch the changes as they happen if the store supports it and poll for them otherwise
+	WatchAuto = "auto"
+	// Poll for changes
+	WatchPoll = "poll"
+	// Don't learn about changes, cached shortlinks are only updated once they expire
+	WatchOff = "off"
+)
+
+// WatchModes lists the valid ways to learn about changes
+var WatchModes = []string{WatchAuto, WatchPoll, WatchOff}
+
+// isWatchMode returns true if the mode is one of WatchModes
+func isWatchMode(mode string) bool {
+	for _, m := range WatchModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Time to wait before watching changes again after watching failed
+var watchRetryInterval = 5 * time.Second
+
+// Time polls for changes reach back before the previous poll to tolerate clock skew between instances
+const pollOverlap = 10 * time.Second
+
+// startCacheWatcher evicts the shortlinks changed by other instances of the service sharing the store
+// from the redirect cache until the returned function is called.
+// Does nothing if the cache is disabled or the store is no ChangeWatcher.
+func (s *server) startCacheWatcher() func() {
+	watcher, ok := s.store.(ChangeWatcher)
+	if !ok || s.cache == nil || s.config.CacheWatch == WatchOff {
+		return func() {}
+	}
+	interval := time.Duration(s.config.CachePollInterval) * time.Second
+	if s.config.CacheWatch == WatchPoll {
+		return s.pollChanges(watcher, interval)
+	}
+
+	// The resume token of the changes seen is kept per host, e.g. per pod
+	name, err := os.Hostname()
+	if err != nil {
+		log.Printf("Could not get the hostname, not resuming watched changes across restarts: %v", err)
+		name = ""
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	stopPolling := func() {}
+	go func() {
+		defer close(done)
+		for {
+			err := watcher.WatchChanges(ctx, name, s.invalidateChange)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, ErrWatchUnsupported) {
+				log.Printf("Store can't be watched, polling for changes every %v", interval)
+				stopPolling = s.pollChanges(watcher, interval)
+				return
+			}
+			log.Printf("Stopped watching changes, retrying in %v: %v", watchRetryInterval, err)
+			select {
+			case <-time.After(watchRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		stopPolling()
+	}
+}
+
+// pollChanges polls the watcher for changes every `interval` until the returned function is called
+func (s *server) pollChanges(watcher ChangeWatcher, interval time.Duration) func() {
+	since := storeTime()
+	return every(interval, func() {
+		changes, next, err := watcher.PollChanges(since.Add(-pollOverlap))
+		if err != nil {
+			log.Printf("Failed polling for changes: %v", err)
+			return
+		}
+		for _, change := range changes {
+			s.invalidateChange(change)
+		}
+		since = next
+	})
+}
+
+// invalidateChange evicts the changed shortlink from the redirect cache and the suggested shorts
+func (s *server) invalidateChange(change *ShortlinkChange) {
+	s.shorts.invalidate()
+	if change.All {
+		s.cache.clear()
+		return
+	}
+	keys := make([]string, len(change.Shorts))
+	for i, short := range change.Shorts {
+		keys[i] = s.shortKey(short)
+	}
+	s.cache.invalidate(change.ID, keys...)
+}